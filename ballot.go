@@ -1,6 +1,10 @@
 package caspaxos
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"time"
+)
 
 // Ballot models a ballot number, which are maintained by proposers and cached
 // by acceptors.
@@ -8,23 +12,56 @@ import "fmt"
 // From the paper: "It's convenient to use tuples as ballot numbers. To generate
 // it a proposer combines its numerical ID with a local increasing counter:
 // (counter, ID)."
+//
+// Ballots also carry an epoch, which is compared before the counter and ID.
+// Proposers bump the epoch when they restart (see NextEpoch) and when their
+// counter overflows, so a reused ID or a reset clock can never produce a
+// ballot that goes backwards. The zero epoch is the default.
 type Ballot struct {
+	Epoch   uint64
 	Counter uint64
 	ID      uint64
 }
 
 func (b *Ballot) inc() Ballot {
+	if b.Counter == math.MaxUint64 {
+		b.Epoch, b.Counter = b.Epoch+1, 0
+		return *b // copy
+	}
 	b.Counter++
 	return *b // copy
 }
 
+// hlcLogicalBits is the number of low bits of the counter reserved for the
+// logical component of a hybrid logical clock. The remaining high bits hold
+// physical time in milliseconds, which will last for a few thousand years.
+const hlcLogicalBits = 16
+
+// incHybrid increments the ballot like inc, except the counter is always at
+// least the physical time, encoded as a hybrid logical clock. Ballots
+// generated this way reflect causality across proposers, roughly, and a
+// proposer that restarts with a zero counter starts out competitive, rather
+// than conflicting with every other proposer until it's been fast-forwarded.
+func (b *Ballot) incHybrid(now time.Time) Ballot {
+	physical := uint64(now.UnixNano()/int64(time.Millisecond)) << hlcLogicalBits
+	if physical > b.Counter {
+		b.Counter = physical
+		return *b // copy
+	}
+	return b.inc()
+}
+
 func (b *Ballot) isZero() bool {
-	return b.Counter == 0 && b.ID == 0
+	return b.Epoch == 0 && b.Counter == 0 && b.ID == 0
 }
 
 // From the paper: "To compare ballot tuples, we should compare the first
-// component of the tuples and use ID only as a tiebreaker."
+// component of the tuples and use ID only as a tiebreaker." The epoch, if
+// any, comes before both.
 func (b *Ballot) greaterThan(other Ballot) bool {
+	if b.Epoch != other.Epoch {
+		return b.Epoch > other.Epoch
+	}
 	if b.Counter == other.Counter {
 		return b.ID > other.ID
 	}
@@ -35,5 +72,70 @@ func (b Ballot) String() string {
 	if b.isZero() {
 		return "ø"
 	}
+	if b.Epoch != 0 {
+		return fmt.Sprintf("Epoch:%d/Counter:%d/ID:%d", b.Epoch, b.Counter, b.ID)
+	}
 	return fmt.Sprintf("Counter:%d/ID:%d", b.Counter, b.ID)
 }
+
+// BallotStrategy generates and compares ballots on behalf of a proposer.
+// Extracting it allows experimenting with, or migrating between, ballot
+// schemes without forking LocalProposer. Greater must agree with the ordering
+// used by the acceptors, which, for the acceptors in this package, is the
+// natural ordering of epoch, then counter, then ID. A proposer serializes its
+// calls to Next and FastForward, but may call Greater concurrently.
+type BallotStrategy interface {
+	// Next returns the ballot for a new attempt, which must be greater than
+	// the current ballot.
+	Next(current Ballot) Ballot
+
+	// FastForward returns the ballot a proposer should continue from, after
+	// its current ballot was rejected in favor of the conflicting ballot.
+	FastForward(current, conflict Ballot) Ballot
+
+	// Greater returns true if a is ordered after b.
+	Greater(a, b Ballot) bool
+}
+
+// CounterBallots returns the default ballot strategy, where the counter is
+// incremented for every attempt, as described in the paper.
+func CounterBallots() BallotStrategy { return counterBallots{} }
+
+type counterBallots struct{}
+
+func (counterBallots) Next(current Ballot) Ballot { return current.inc() }
+
+func (counterBallots) FastForward(current, conflict Ballot) Ballot {
+	return fastForward(current, conflict)
+}
+
+func (counterBallots) Greater(a, b Ballot) bool { return a.greaterThan(b) }
+
+// HybridClockBallots returns a ballot strategy where the counter is a hybrid
+// logical clock, based on the given physical clock, typically time.Now.
+// Proposers that use this strategy and proposers that use CounterBallots are
+// compatible.
+func HybridClockBallots(now func() time.Time) BallotStrategy {
+	return hybridClockBallots{now}
+}
+
+type hybridClockBallots struct{ now func() time.Time }
+
+func (s hybridClockBallots) Next(current Ballot) Ballot { return current.incHybrid(s.now()) }
+
+func (hybridClockBallots) FastForward(current, conflict Ballot) Ballot {
+	return fastForward(current, conflict)
+}
+
+// fastForward adopts the epoch and counter of the conflicting ballot, if it's
+// greater. A prepare can fail without any conflicts, e.g. if acceptors are
+// unreachable, in which case the conflict is the zero ballot, and the current
+// ballot must not go backwards.
+func fastForward(current, conflict Ballot) Ballot {
+	if conflict.greaterThan(current) {
+		current.Epoch, current.Counter = conflict.Epoch, conflict.Counter
+	}
+	return current
+}
+
+func (hybridClockBallots) Greater(a, b Ballot) bool { return a.greaterThan(b) }
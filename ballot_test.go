@@ -2,7 +2,9 @@ package caspaxos
 
 import (
 	"fmt"
+	"math"
 	"testing"
+	"time"
 )
 
 func TestZeroBallotAlwaysLoses(t *testing.T) {
@@ -13,6 +15,7 @@ func TestZeroBallotAlwaysLoses(t *testing.T) {
 		{Counter: 1, ID: 2},
 		{Counter: 2, ID: 1},
 		{Counter: 2, ID: 2},
+		{Epoch: 1},
 	} {
 		t.Run(fmt.Sprintf("%+v", input), func(t *testing.T) {
 			var zero Ballot
@@ -36,3 +39,83 @@ func TestBallotIncrement(t *testing.T) {
 		t.Fatalf("persistent ballot number: want %d, have %d", want, have)
 	}
 }
+
+func TestBallotIncrementHybrid(t *testing.T) {
+	var (
+		b    Ballot
+		now  = time.Now()
+		prev Ballot
+	)
+
+	// The counter jumps to the physical time.
+	next := b.incHybrid(now)
+	if want, have := uint64(now.UnixNano()/int64(time.Millisecond)), next.Counter>>hlcLogicalBits; want != have {
+		t.Fatalf("physical component: want %d, have %d", want, have)
+	}
+
+	// It always increases, even if the clock stands still or goes backwards.
+	for _, t0 := range []time.Time{now, now, now.Add(-time.Hour), now.Add(time.Millisecond)} {
+		prev, next = next, b.incHybrid(t0)
+		if !next.greaterThan(prev) {
+			t.Fatalf("%s isn't greater than %s", next, prev)
+		}
+	}
+
+	// And, if it's already ahead of the physical time, it acts as a counter.
+	b = Ballot{Counter: next.Counter + 1000}
+	if want, have := next.Counter+1001, b.incHybrid(now).Counter; want != have {
+		t.Fatalf("counter ahead of clock: want %d, have %d", want, have)
+	}
+}
+
+func TestBallotStrategies(t *testing.T) {
+	for name, s := range map[string]BallotStrategy{
+		"counter": CounterBallots(),
+		"hybrid":  HybridClockBallots(time.Now),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var (
+				orig = Ballot{Counter: 1, ID: 7}
+				next = s.Next(orig)
+			)
+			if !s.Greater(next, orig) {
+				t.Errorf("Next: %s isn't greater than %s", next, orig)
+			}
+			var (
+				conflict = Ballot{Counter: next.Counter + 100, ID: 9}
+				ff       = s.FastForward(next, conflict)
+			)
+			if want, have := uint64(7), ff.ID; want != have {
+				t.Errorf("FastForward: ID: want %d, have %d", want, have)
+			}
+			if again := s.Next(ff); !s.Greater(again, conflict) {
+				t.Errorf("Next after FastForward: %s isn't greater than %s", again, conflict)
+			}
+		})
+	}
+}
+
+func TestBallotEpoch(t *testing.T) {
+	var (
+		older = Ballot{Epoch: 1, Counter: 1000, ID: 9}
+		newer = Ballot{Epoch: 2, Counter: 1, ID: 1}
+	)
+	if !newer.greaterThan(older) || older.greaterThan(newer) {
+		t.Errorf("epoch should be compared first")
+	}
+
+	// Counter overflow bumps the epoch, so ballots never go backwards.
+	b := Ballot{Epoch: 1, Counter: math.MaxUint64, ID: 1}
+	prev := b
+	if next := b.inc(); !next.greaterThan(prev) {
+		t.Errorf("after overflow: %s isn't greater than %s", next, prev)
+	}
+
+	// Fast-forwarding to a lesser or zero ballot doesn't go backwards.
+	if want, have := newer, fastForward(newer, Ballot{}); want != have {
+		t.Errorf("fast-forward to zero: want %s, have %s", want, have)
+	}
+	if want, have := (Ballot{Epoch: 2, Counter: 1000, ID: 1}), fastForward(newer, Ballot{Epoch: 2, Counter: 1000, ID: 9}); want != have {
+		t.Errorf("fast-forward: want %s, have %s", want, have)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 )
@@ -228,3 +229,33 @@ func TestConcurrentCASWrites(t *testing.T) {
 		}
 	}
 }
+
+func TestHybridClockRestart(t *testing.T) {
+	// Build the cluster.
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		m      = newTestMetrics()
+		p1     = NewLocalProposerWithOptions(1, log.With(logger, "p", 1), []Acceptor{a1, a2, a3}, ProposerHybridClock())
+		ctx    = context.Background()
+	)
+
+	// Make a lot of proposals.
+	for i := 0; i < 100; i++ {
+		if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a restart of p1. The new incarnation shouldn't conflict.
+	p1 = NewLocalProposerWithOptions(1, log.With(logger, "p", 1), []Acceptor{a1, a2, a3}, ProposerHybridClock(), ProposerMetrics(m))
+	time.Sleep(2 * time.Millisecond)
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0.0, m.value("conflicts"); want != have {
+		t.Errorf("conflicts after restart: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,148 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// CompareAndSwap returns a ChangeFunc which sets the value to next, if the
+// current value is equal to current. A nil current matches only a missing
+// value. Otherwise, the value is left unchanged.
+func CompareAndSwap(current, next []byte) ChangeFunc {
+	return func(x []byte) []byte {
+		if (x == nil) == (current == nil) && bytes.Equal(x, current) {
+			return next
+		}
+		return x
+	}
+}
+
+// MergeFunc reconciles a failed compare-and-swap. Given the value actually
+// found, and the value the caller intended to write, it returns the value to
+// write instead. If ok is false, the value is left unchanged.
+type MergeFunc func(found, intended []byte) (merged []byte, ok bool)
+
+// CompareAndSwapMerge returns a ChangeFunc which sets the value to next, if
+// the current value is equal to current, like CompareAndSwap. Otherwise, it
+// sets the value to the result of merge. This is the usual "retry with rebase"
+// loop, but because a ChangeFunc is applied to the latest value within a
+// single round, the re-read and the retry aren't necessary. The merge func may
+// be called more than once, if the proposal is retried, so it should be pure.
+func CompareAndSwapMerge(current, next []byte, merge MergeFunc) ChangeFunc {
+	return func(x []byte) []byte {
+		if (x == nil) == (current == nil) && bytes.Equal(x, current) {
+			return next
+		}
+		if merged, ok := merge(x, next); ok {
+			return merged
+		}
+		return x
+	}
+}
+
+// CASCoalescer wraps a proposer, and coalesces identical compare-and-swap
+// operations: while a CAS for a key, current value, and next value is in
+// flight, further identical CASes wait for it, and share its result, rather
+// than starting rounds of their own. This cuts acceptor load when many clients
+// race the same update, e.g. a thundering herd applying a config change.
+//
+// Because the waiters share a single round, they all observe the same result:
+// if it swapped, every waiter is told it swapped, even though, run one after
+// another, only the first would have. For identical updates, that's usually
+// what callers want.
+type CASCoalescer struct {
+	proposer Proposer
+	joined   func() // called when a CAS joins one in flight
+
+	mtx   sync.Mutex
+	calls map[casKey]*casCall
+}
+
+type casKey struct {
+	key, current, next  string
+	currentNil, nextNil bool
+}
+
+type casCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc // cancels the round
+	waiters int                // callers still waiting for the round
+	state   []byte
+	swapped bool
+	err     error
+}
+
+// NewCASCoalescer returns a CASCoalescer which proposes via proposer.
+func NewCASCoalescer(proposer Proposer) *CASCoalescer {
+	return &CASCoalescer{
+		proposer: proposer,
+		joined:   func() {},
+		calls:    map[casKey]*casCall{},
+	}
+}
+
+// CompareAndSwap sets the value of key to next, if it's currently equal to
+// current, and returns the resulting state, and whether the swap happened.
+// The round doesn't belong to any one caller, so it's unaffected by their
+// contexts: a caller whose context is canceled stops waiting and returns the
+// context error, and the round carries on for the others. Once every caller
+// has stopped waiting, the round is canceled.
+func (c *CASCoalescer) CompareAndSwap(ctx context.Context, key string, current, next []byte) (state []byte, swapped bool, err error) {
+	k := casKey{key, string(current), string(next), current == nil, next == nil}
+
+	c.mtx.Lock()
+	call, ok := c.calls[k]
+	if !ok {
+		roundCtx, cancel := context.WithCancel(context.Background())
+		call = &casCall{done: make(chan struct{}), cancel: cancel}
+		c.calls[k] = call
+		go c.round(roundCtx, k, call, current, next)
+	}
+	call.waiters++
+	c.mtx.Unlock()
+
+	if ok {
+		c.joined()
+	}
+	defer c.leave(k, call)
+
+	select {
+	case <-call.done:
+		return call.state, call.swapped, call.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// round proposes the CAS, and publishes the result to the call's waiters.
+func (c *CASCoalescer) round(ctx context.Context, k casKey, call *casCall, current, next []byte) {
+	var matched bool
+	call.state, call.err = c.proposer.Propose(ctx, k.key, func(x []byte) []byte {
+		matched = (x == nil) == (current == nil) && bytes.Equal(x, current)
+		return CompareAndSwap(current, next)(x)
+	})
+	call.swapped = call.err == nil && matched
+
+	c.mtx.Lock()
+	if c.calls[k] == call {
+		delete(c.calls, k)
+	}
+	c.mtx.Unlock()
+	call.cancel()
+	close(call.done)
+}
+
+// leave records that a caller has stopped waiting for the call. If it was the
+// last one, the round is canceled, and later callers start a new one.
+func (c *CASCoalescer) leave(k casKey, call *casCall) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if call.waiters--; call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	if c.calls[k] == call {
+		delete(c.calls, k)
+	}
+}
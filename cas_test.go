@@ -0,0 +1,156 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	for _, tc := range []struct {
+		value, current, next, want []byte
+	}{
+		{nil, nil, []byte("a"), []byte("a")},
+		{[]byte{}, nil, []byte("a"), []byte{}},
+		{[]byte("a"), []byte("a"), []byte("b"), []byte("b")},
+		{[]byte("a"), []byte("x"), []byte("b"), []byte("a")},
+	} {
+		if have := CompareAndSwap(tc.current, tc.next)(tc.value); string(tc.want) != string(have) || (tc.want == nil) != (have == nil) {
+			t.Errorf("CAS(%q→%q) on %q: want %q, have %q", tc.current, tc.next, tc.value, tc.want, have)
+		}
+	}
+}
+
+func TestCompareAndSwapMerge(t *testing.T) {
+	// The merge appends the intended suffix, unless it's already there.
+	merge := func(found, intended []byte) ([]byte, bool) {
+		if bytes.HasSuffix(found, intended) {
+			return nil, false
+		}
+		return append(append([]byte{}, found...), intended...), true
+	}
+	for _, tc := range []struct {
+		value, current, next, want []byte
+	}{
+		{[]byte("a"), []byte("a"), []byte("b"), []byte("b")},   // swapped
+		{[]byte("x"), []byte("a"), []byte("b"), []byte("xb")},  // merged
+		{[]byte("xb"), []byte("a"), []byte("b"), []byte("xb")}, // merge declined
+		{nil, []byte("a"), []byte("b"), []byte("b")},           // merged with missing value
+	} {
+		if have := CompareAndSwapMerge(tc.current, tc.next, merge)(tc.value); string(tc.want) != string(have) {
+			t.Errorf("CAS(%q→%q) on %q: want %q, have %q", tc.current, tc.next, tc.value, tc.want, have)
+		}
+	}
+}
+
+func TestCASCoalescer(t *testing.T) {
+	var (
+		a1      = NewMemoryAcceptor("1")
+		a2      = NewMemoryAcceptor("2")
+		a3      = NewMemoryAcceptor("3")
+		release = make(chan struct{})
+		p1      = &countingProposer{Proposer: NewLocalProposer(1, nil, a1, a2, a3), gate: release}
+		c       = NewCASCoalescer(p1)
+		ctx     = context.Background()
+	)
+
+	const n = 10
+	var (
+		wg      sync.WaitGroup
+		swapped int64
+		joined  = make(chan struct{}, n)
+	)
+	c.joined = func() { joined <- struct{}{} }
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, ok, err := c.CompareAndSwap(ctx, "k", nil, []byte("v1"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(state) != "v1" {
+				t.Errorf("state: want %q, have %q", "v1", state)
+			}
+			if ok {
+				atomic.AddInt64(&swapped, 1)
+			}
+		}()
+	}
+	for i := 0; i < n-1; i++ {
+		<-joined // every CAS but the first joins the first one
+	}
+	close(release)
+	wg.Wait()
+
+	if want, have := int64(1), atomic.LoadInt64(&p1.calls); want != have {
+		t.Errorf("rounds: want %d, have %d", want, have)
+	}
+	if want, have := int64(n), atomic.LoadInt64(&swapped); want != have {
+		t.Errorf("swapped: want %d, have %d", want, have)
+	}
+
+	// Once the round is over, a stale CAS runs its own round, and fails.
+	if _, ok, err := c.CompareAndSwap(ctx, "k", nil, []byte("v2")); err != nil || ok {
+		t.Errorf("stale CAS: want no swap, have swapped=%v, err=%v", ok, err)
+	}
+}
+
+func TestCASCoalescerCancel(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		p1      = &countingProposer{Proposer: NewLocalProposer(1, nil, NewMemoryAcceptor("1")), gate: release}
+		c       = NewCASCoalescer(p1)
+		joined  = make(chan struct{}, 1)
+		first   = make(chan error, 1)
+		second  = make(chan error, 1)
+	)
+	c.joined = func() { joined <- struct{}{} }
+
+	// Two callers share a round. Whichever of them started it, the round
+	// doesn't depend on their contexts.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _, err := c.CompareAndSwap(ctx, "k", nil, []byte("v"))
+		first <- err
+	}()
+	go func() {
+		_, ok, err := c.CompareAndSwap(context.Background(), "k", nil, []byte("v"))
+		if err == nil && !ok {
+			err = errors.New("not swapped")
+		}
+		second <- err
+	}()
+	<-joined
+
+	// The first caller gives up, but that doesn't fail the round for the
+	// second.
+	cancel()
+	if want, have := context.Canceled, <-first; want != have {
+		t.Errorf("first caller: want %v, have %v", want, have)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("second caller: %v", err)
+	}
+	if want, have := int64(1), atomic.LoadInt64(&p1.calls); want != have {
+		t.Errorf("rounds: want %d, have %d", want, have)
+	}
+}
+
+// countingProposer counts proposals, and blocks each until gate is closed.
+type countingProposer struct {
+	Proposer
+	gate  chan struct{}
+	calls int64
+}
+
+func (p *countingProposer) Propose(ctx context.Context, key string, f ChangeFunc) ([]byte, error) {
+	atomic.AddInt64(&p.calls, 1)
+	<-p.gate
+	return p.Proposer.Propose(ctx, key, f)
+}
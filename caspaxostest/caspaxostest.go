@@ -0,0 +1,267 @@
+// Package caspaxostest provides a conformance suite for implementations of
+// caspaxos.Acceptor and caspaxos.Proposer, e.g. network transports and custom
+// storage backends. Call the suites from an ordinary test:
+//
+//	func TestConformance(t *testing.T) {
+//		caspaxostest.TestAcceptor(t, func() caspaxos.Acceptor {
+//			return newMyAcceptor()
+//		})
+//	}
+package caspaxostest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/peterbourgon/caspaxos"
+)
+
+// TestAcceptor runs the acceptor conformance suite. The constructor is called
+// once per subtest, and should return a fresh acceptor with no state. If the
+// acceptor implements caspaxos.Purger, purges are checked, too.
+func TestAcceptor(t *testing.T, newAcceptor func() caspaxos.Acceptor) {
+	var (
+		ctx = context.Background()
+		b1  = caspaxos.Ballot{Counter: 1, ID: 1}
+		b2  = caspaxos.Ballot{Counter: 2, ID: 1}
+		b3  = caspaxos.Ballot{Counter: 2, ID: 2}
+	)
+
+	t.Run("EmptyPrepare", func(t *testing.T) {
+		a := newAcceptor()
+		value, current, err := a.Prepare(ctx, "k", b1)
+		if err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		if value != nil || current != (caspaxos.Ballot{}) {
+			t.Errorf("Prepare: want empty value and zero ballot, have %q, %s", value, current)
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		a := newAcceptor()
+		mustPrepare(t, a, "k", b1)
+		mustAccept(t, a, "k", b1, "x")
+		value, current := mustPrepare(t, a, "k", b2)
+		if want, have := "x", string(value); want != have {
+			t.Errorf("value: want %q, have %q", want, have)
+		}
+		if want, have := b1, current; want != have {
+			t.Errorf("ballot: want %s, have %s", want, have)
+		}
+	})
+
+	t.Run("EmptyValueIsNotNil", func(t *testing.T) {
+		a := newAcceptor()
+		mustPrepare(t, a, "k", b1)
+		mustAccept(t, a, "k", b1, "")
+		if value, _ := mustPrepare(t, a, "k", b2); value == nil {
+			t.Errorf("accepted empty value was returned as nil")
+		}
+	})
+
+	t.Run("BallotOrdering", func(t *testing.T) {
+		for _, tc := range []struct{ lesser, greater caspaxos.Ballot }{
+			{b1, b2}, // counter
+			{b2, b3}, // ID breaks ties
+			{caspaxos.Ballot{Counter: 100, ID: 9}, caspaxos.Ballot{Epoch: 1, Counter: 1, ID: 1}}, // epoch first
+		} {
+			a := newAcceptor()
+			mustPrepare(t, a, "k", tc.greater)
+			expectConflict(t, "Prepare", tc.greater, func() (caspaxos.Ballot, error) {
+				_, current, err := a.Prepare(ctx, "k", tc.lesser)
+				return current, err
+			})
+			expectConflict(t, "Accept", tc.greater, func() (caspaxos.Ballot, error) {
+				return tc.greater, a.Accept(ctx, "k", tc.lesser, []byte("x"))
+			})
+		}
+	})
+
+	t.Run("ConflictReportsAcceptedBallot", func(t *testing.T) {
+		a := newAcceptor()
+		mustPrepare(t, a, "k", b2)
+		mustAccept(t, a, "k", b2, "x")
+		expectConflict(t, "Prepare", b2, func() (caspaxos.Ballot, error) {
+			_, current, err := a.Prepare(ctx, "k", b1)
+			return current, err
+		})
+	})
+
+	t.Run("AcceptWithoutPromise", func(t *testing.T) {
+		// rystsov: the promise may be empty during the accept phase, as long
+		// as the ballot is greater than the accepted ballot.
+		a := newAcceptor()
+		mustAccept(t, a, "k", b1, "x")
+		mustAccept(t, a, "k", b2, "y")
+	})
+
+	t.Run("Idempotence", func(t *testing.T) {
+		a := newAcceptor()
+		mustPrepare(t, a, "k", b1)
+		mustPrepare(t, a, "k", b1)
+		mustAccept(t, a, "k", b1, "x")
+		mustAccept(t, a, "k", b1, "x")
+
+		// Preparing the accepted ballot again is allowed, and reports it.
+		value, current := mustPrepare(t, a, "k", b1)
+		if string(value) != "x" || current != b1 {
+			t.Errorf("re-prepare: want %q at %s, have %q at %s", "x", b1, value, current)
+		}
+	})
+
+	t.Run("KeysAreIndependent", func(t *testing.T) {
+		a := newAcceptor()
+		mustPrepare(t, a, "k1", b2)
+		mustAccept(t, a, "k1", b2, "x")
+		value, current := mustPrepare(t, a, "k2", b1)
+		if value != nil || current != (caspaxos.Ballot{}) {
+			t.Errorf("k2: want empty, have %q at %s", value, current)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		a := newAcceptor()
+		purger, ok := a.(caspaxos.Purger)
+		if !ok {
+			t.Skip("acceptor doesn't implement caspaxos.Purger")
+		}
+		mustAccept(t, a, "k", b1, "x")
+		if err := purger.Purge(ctx, "k", b1); err == nil {
+			t.Errorf("Purge of a non-empty value: want error, have none")
+		}
+		if err := a.Accept(ctx, "k", b2, nil); err != nil {
+			t.Fatalf("Accept(k, %s): %v", b2, err)
+		}
+		if err := purger.Purge(ctx, "k", b2); err != nil {
+			t.Fatalf("Purge: %v", err)
+		}
+		if err := purger.Purge(ctx, "k", b2); err != nil {
+			t.Errorf("Purge again: %v", err)
+		}
+		expectConflict(t, "Prepare after purge", b2, func() (caspaxos.Ballot, error) {
+			_, current, err := a.Prepare(ctx, "k", b1)
+			return current, err
+		})
+		if value, _ := mustPrepare(t, a, "k", b3); value != nil {
+			t.Errorf("purged key: want empty value, have %q", value)
+		}
+	})
+
+	t.Run("ContextCancellation", func(t *testing.T) {
+		a := newAcceptor()
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, _, err := a.Prepare(canceled, "k", b1); err == nil {
+			t.Errorf("Prepare with canceled context: want error, have none")
+		}
+		if err := a.Accept(canceled, "k", b1, []byte("x")); err == nil {
+			t.Errorf("Accept with canceled context: want error, have none")
+		}
+		if value, _ := mustPrepare(t, a, "k", b2); value != nil {
+			t.Errorf("canceled Accept was applied: have %q", value)
+		}
+	})
+}
+
+// TestProposer runs the proposer conformance suite. The constructor is called
+// once per subtest, and should return a proposer for a fresh cluster.
+func TestProposer(t *testing.T, newProposer func() caspaxos.Proposer) {
+	ctx := context.Background()
+
+	t.Run("InitializeOnlyOnce", func(t *testing.T) {
+		p := newProposer()
+		for _, s := range []string{"x", "y"} {
+			value, err := p.Propose(ctx, "k", initializeOnlyOnce(s))
+			if err != nil {
+				t.Fatalf("Propose: %v", err)
+			}
+			if want, have := "x", string(value); want != have {
+				t.Errorf("want %q, have %q", want, have)
+			}
+		}
+	})
+
+	t.Run("ReadOfMissingKey", func(t *testing.T) {
+		p := newProposer()
+		value, err := p.Propose(ctx, "k", read)
+		if err != nil {
+			t.Fatalf("Propose: %v", err)
+		}
+		if value != nil {
+			t.Errorf("want nil, have %q", value)
+		}
+	})
+
+	t.Run("SequentialChanges", func(t *testing.T) {
+		p := newProposer()
+		for i := 1; i <= 10; i++ {
+			value, err := p.Propose(ctx, "k", func(current []byte) []byte {
+				return []byte(fmt.Sprintf("%s%d", current, i%10))
+			})
+			if err != nil {
+				t.Fatalf("change %d: %v", i, err)
+			}
+			if want, have := "1234567890"[:i], string(value); want != have {
+				t.Fatalf("change %d: want %q, have %q", i, want, have)
+			}
+		}
+	})
+
+	t.Run("ContextCancellation", func(t *testing.T) {
+		p := newProposer()
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := p.Propose(canceled, "k", initializeOnlyOnce("x")); err == nil {
+			t.Errorf("want error, have none")
+		}
+		if value, err := p.Propose(ctx, "k", read); err != nil {
+			t.Errorf("read: %v", err)
+		} else if value != nil {
+			t.Errorf("canceled proposal was applied: have %q", value)
+		}
+	})
+}
+
+func mustPrepare(t *testing.T, a caspaxos.Acceptor, key string, b caspaxos.Ballot) ([]byte, caspaxos.Ballot) {
+	t.Helper()
+	value, current, err := a.Prepare(context.Background(), key, b)
+	if err != nil {
+		t.Fatalf("Prepare(%s, %s): %v", key, b, err)
+	}
+	return value, current
+}
+
+func mustAccept(t *testing.T, a caspaxos.Acceptor, key string, b caspaxos.Ballot, value string) {
+	t.Helper()
+	if err := a.Accept(context.Background(), key, b, []byte(value)); err != nil {
+		t.Fatalf("Accept(%s, %s): %v", key, b, err)
+	}
+}
+
+// expectConflict checks that f fails with a caspaxos.ConflictError, and
+// reports the existing ballot.
+func expectConflict(t *testing.T, method string, existing caspaxos.Ballot, f func() (caspaxos.Ballot, error)) {
+	t.Helper()
+	current, err := f()
+	ce, ok := err.(caspaxos.ConflictError)
+	if !ok {
+		t.Errorf("%s: want ConflictError, have %v", method, err)
+		return
+	}
+	if ce.Existing != existing || current != existing {
+		t.Errorf("%s: want existing ballot %s, have %s (returned %s)", method, existing, ce.Existing, current)
+	}
+}
+
+func initializeOnlyOnce(s string) caspaxos.ChangeFunc {
+	return func(current []byte) []byte {
+		if current == nil {
+			return []byte(s)
+		}
+		return current
+	}
+}
+
+func read(current []byte) []byte { return current }
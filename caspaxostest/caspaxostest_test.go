@@ -0,0 +1,61 @@
+package caspaxostest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peterbourgon/caspaxos"
+)
+
+func TestMemoryAcceptor(t *testing.T) {
+	TestAcceptor(t, func() caspaxos.Acceptor {
+		return caspaxos.NewMemoryAcceptor("1")
+	})
+}
+
+func TestTieredAcceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxostest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	TestAcceptor(t, func() caspaxos.Acceptor {
+		a, err := caspaxos.NewTieredAcceptor("1", dir, 0) // spill everything
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	})
+}
+
+func TestDiskAcceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxostest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var n int
+	TestAcceptor(t, func() caspaxos.Acceptor {
+		n++
+		a, err := caspaxos.NewDiskAcceptor("1", filepath.Join(dir, fmt.Sprint(n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	})
+}
+
+func TestLocalProposer(t *testing.T) {
+	TestProposer(t, func() caspaxos.Proposer {
+		acceptors := make([]caspaxos.Acceptor, 3)
+		for i := range acceptors {
+			acceptors[i] = caspaxos.NewMemoryAcceptor(fmt.Sprint(i + 1))
+		}
+		return caspaxos.NewLocalProposer(1, nil, acceptors...)
+	})
+}
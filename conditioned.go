@@ -0,0 +1,38 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+)
+
+// ConditionedProposer models a proposer which supports optimistic concurrency
+// control against ballots, rather than values. This is useful for large
+// values, which are expensive to compare, and for fencing: a caller that
+// holds the ballot of the value it last saw can be sure nobody else has
+// changed the value in the meantime.
+//
+// Note that in CASPaxos every proposal, including a read via an identity
+// change function, rewrites the value with a new ballot. So a read by any
+// proposer advances the ballot, and causes a subsequent ProposeIf with the
+// previous ballot to fail, even though the value hasn't changed.
+type ConditionedProposer interface {
+	Proposer
+
+	// ProposeIf applies f only if the value for key was last accepted with
+	// the expected ballot, and returns the new state and the ballot it was
+	// accepted with. The zero ballot means the key has never been written.
+	// If the ballot has advanced, nothing is changed, and ProposeIf returns
+	// a BallotMismatchError.
+	ProposeIf(ctx context.Context, key string, expected Ballot, f ChangeFunc) (newState []byte, b Ballot, err error)
+}
+
+// BallotMismatchError is returned by ProposeIf when the value has been
+// accepted with a different ballot than expected.
+type BallotMismatchError struct {
+	Expected Ballot
+	Current  Ballot
+}
+
+func (bme BallotMismatchError) Error() string {
+	return fmt.Sprintf("ballot mismatch: expected %s, current %s", bme.Expected, bme.Current)
+}
@@ -0,0 +1,48 @@
+package caspaxos
+
+import (
+	"context"
+	"testing"
+)
+
+var _ ConditionedProposer = (*LocalProposer)(nil)
+
+func TestProposeIf(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = NewLocalProposer(1, nil, a1, a2, a3)
+		p2  = NewLocalProposer(2, nil, a1, a2, a3)
+		ctx = context.Background()
+	)
+
+	// The zero ballot means the key doesn't exist yet.
+	_, b1, err := p1.ProposeIf(ctx, "k", Ballot{}, changeFuncInitializeOnlyOnce("x"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// With the ballot from the last proposal, a change succeeds.
+	_, b2, err := p1.ProposeIf(ctx, "k", b1, func([]byte) []byte { return []byte("y") })
+	if err != nil {
+		t.Fatalf("change: %v", err)
+	}
+
+	// A read by another proposer advances the ballot, so the stale ballot
+	// fails, and nothing is changed.
+	if _, err := p2.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = p1.ProposeIf(ctx, "k", b2, func([]byte) []byte { return []byte("z") })
+	mismatch, ok := err.(BallotMismatchError)
+	if !ok {
+		t.Fatalf("stale ballot: want BallotMismatchError, have %v", err)
+	}
+	if want, have := b2, mismatch.Expected; want != have {
+		t.Errorf("expected ballot: want %s, have %s", want, have)
+	}
+	if value, _, _ := p1.ProposeBallot(ctx, "k", changeFuncRead); string(value) != "y" {
+		t.Errorf("value: want %q, have %q", "y", value)
+	}
+}
@@ -8,6 +8,11 @@ import (
 )
 
 // Proposer models a concrete proposer.
+//
+// Membership changes that drive the whole protocol, like LocalProposer's
+// AddAcceptor and RemoveAcceptor, are deliberately not part of the interface:
+// adding them would break every Proposer implemented outside this package.
+// Use GrowCluster and ShrinkCluster, which work with any Proposer.
 type Proposer interface {
 	Propose(ctx context.Context, key string, f ChangeFunc) (newState []byte, err error)
 
@@ -46,7 +51,10 @@ const zerokey = ""
 // for any cluster change; turning a node on at different points in that process
 // depending on the cardinality of the node-set is fraught with peril.
 
-// GrowCluster adds the target acceptor to the cluster of proposers.
+// GrowCluster adds the target acceptor to the cluster of proposers. Proposers
+// which already have the target as an accepter, or as a preparer, skip that
+// step, so a GrowCluster that was interrupted, e.g. by a crash, can be
+// completed by calling it again.
 func GrowCluster(ctx context.Context, target Acceptor, proposers ...Proposer) error {
 	// If we fail, try to leave the cluster in its original state.
 	var undo []func()
@@ -60,9 +68,14 @@ func GrowCluster(ctx context.Context, target Acceptor, proposers ...Proposer) er
 	// send the 'accept' messages to the [new] set of acceptors, and to require
 	// F+2 confirmations during the 'accept' phase."
 	for _, proposer := range proposers {
-		if err := proposer.AddAccepter(target); err != nil {
+		err := proposer.AddAccepter(target)
+		if err == ErrDuplicate {
+			continue
+		}
+		if err != nil {
 			return errors.Wrap(err, "during grow step 1 (add accepter)")
 		}
+		proposer := proposer // for the closure
 		undo = append(undo, func() { proposer.RemoveAccepter(target) })
 	}
 
@@ -80,9 +93,14 @@ func GrowCluster(ctx context.Context, target Acceptor, proposers ...Proposer) er
 	// send 'prepare' messages to the [new] set of acceptors, and to require F+2
 	// confirmations [during the 'prepare' phase]."
 	for _, proposer := range proposers {
-		if err := proposer.AddPreparer(target); err != nil {
+		err := proposer.AddPreparer(target)
+		if err == ErrDuplicate {
+			continue
+		}
+		if err != nil {
 			return errors.Wrap(err, "during grow step 3 (add preparer)")
 		}
+		proposer := proposer // for the closure
 		undo = append(undo, func() { proposer.RemovePreparer(target) })
 	}
 
@@ -91,7 +109,9 @@ func GrowCluster(ctx context.Context, target Acceptor, proposers ...Proposer) er
 	return nil
 }
 
-// ShrinkCluster removes the target acceptor from the cluster of proposers.
+// ShrinkCluster removes the target acceptor from the cluster of proposers. Like
+// GrowCluster, it skips the steps which proposers have already taken, so an
+// interrupted ShrinkCluster can be completed by calling it again.
 func ShrinkCluster(ctx context.Context, target Acceptor, proposers ...Proposer) error {
 	// If we fail, try to leave the cluster in its original state.
 	var undo []func()
@@ -106,9 +126,14 @@ func ShrinkCluster(ctx context.Context, target Acceptor, proposers ...Proposer)
 
 	// So, remove it as a preparer.
 	for _, proposer := range proposers {
-		if err := proposer.RemovePreparer(target); err != nil {
+		err := proposer.RemovePreparer(target)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
 			return errors.Wrap(err, "during shrink step 1 (remove preparer)")
 		}
+		proposer := proposer // for the closure
 		undo = append(undo, func() { proposer.AddPreparer(target) })
 	}
 
@@ -123,9 +148,14 @@ func ShrinkCluster(ctx context.Context, target Acceptor, proposers ...Proposer)
 
 	// And then remove it as an accepter.
 	for _, proposer := range proposers {
-		if err := proposer.RemoveAccepter(target); err != nil {
+		err := proposer.RemoveAccepter(target)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
 			return errors.Wrap(err, "during shrink step 3 (remove accepter)")
 		}
+		proposer := proposer // for the closure
 		undo = append(undo, func() { proposer.AddAccepter(target) })
 	}
 
@@ -133,3 +163,74 @@ func ShrinkCluster(ctx context.Context, target Acceptor, proposers ...Proposer)
 	undo = []func(){}
 	return nil
 }
+
+// JointProposer is a Proposer which supports joint configuration changes.
+type JointProposer interface {
+	Proposer
+
+	EnterJoint(next []Acceptor) error
+	CommitJoint() error
+	AbortJoint() error
+}
+
+// ChangeConfiguration replaces the acceptors of the proposers with the next
+// set, which may differ from the current set arbitrarily, e.g. by several
+// acceptors, or even completely. GrowCluster and ShrinkCluster are only safe
+// when adding or removing a single acceptor at a time.
+//
+// The change uses joint consensus, which works in three steps. First, every
+// proposer enters a joint configuration, where each phase must be confirmed by
+// a majority of both the current and the next set of acceptors. Proposers in
+// the joint configuration and proposers that haven't entered it yet both
+// require a majority of the current set, so their quorums always intersect.
+// Second, each of the given keys is rewritten via the identity transaction,
+// which guarantees its value is held by a majority of the next set. Third,
+// every proposer commits the change, and uses only the next set. Proposers
+// that have committed and proposers still in the joint configuration both
+// require a majority of the next set, so, again, their quorums intersect. At
+// no point can two disjoint quorums choose different values.
+//
+// The keys must include every key with a value that should survive the
+// change; a key that isn't rewritten in the second step may appear empty to
+// proposers once they've committed. If the change fails before the third
+// step, the proposers are returned to their original configuration.
+func ChangeConfiguration(ctx context.Context, next []Acceptor, keys []string, proposers ...JointProposer) error {
+	// If we fail, try to leave the cluster in its original state.
+	var undo []func()
+	defer func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}()
+
+	// Enter the joint configuration.
+	for _, proposer := range proposers {
+		if err := proposer.EnterJoint(next); err != nil {
+			return errors.Wrap(err, "during change step 1 (enter joint)")
+		}
+		proposer := proposer // for the closure
+		undo = append(undo, func() { proposer.AbortJoint() })
+	}
+
+	// Rewrite every key under the joint configuration. The zero key gets the
+	// same treatment, as in GrowCluster and ShrinkCluster.
+	var (
+		identity = func(x []byte) []byte { return x }
+		proposer = proposers[rand.Intn(len(proposers))]
+	)
+	for _, key := range append([]string{zerokey}, keys...) {
+		if _, err := proposer.Propose(ctx, key, identity); err != nil {
+			return errors.Wrapf(err, "during change step 2 (identity read of %q)", key)
+		}
+	}
+
+	// Commit the change. This can't be undone.
+	undo = []func(){}
+	for _, proposer := range proposers {
+		if err := proposer.CommitJoint(); err != nil {
+			return errors.Wrap(err, "during change step 3 (commit joint)")
+		}
+	}
+
+	return nil
+}
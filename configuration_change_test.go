@@ -78,3 +78,211 @@ func TestConfigurationChange(t *testing.T) {
 	shrinkClusterWith(a4)
 	verifyReads()
 }
+
+func TestChangeConfigurationDisjoint(t *testing.T) {
+	// Build the cluster.
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("1")}
+		a2     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("2")}
+		a3     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("3")}
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+		ctx    = context.Background()
+		values = map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}
+		keys   = []string{"k1", "k2", "k3"}
+	)
+	for key, val := range values {
+		if _, err := p1.Propose(ctx, key, changeFuncInitializeOnlyOnce(val)); err != nil {
+			t.Fatalf("initial write of %s: %v", key, err)
+		}
+	}
+
+	// Replace every acceptor at once.
+	var (
+		a4 = NewMemoryAcceptor("4")
+		a5 = NewMemoryAcceptor("5")
+		a6 = NewMemoryAcceptor("6")
+	)
+	if err := ChangeConfiguration(ctx, []Acceptor{a4, a5, a6}, keys, p1, p2); err != nil {
+		t.Fatalf("change configuration: %v", err)
+	}
+
+	// Take down the original acceptors. Reads should still work.
+	for _, a := range []*flakyAcceptor{a1, a2, a3} {
+		a.setFailing(true)
+	}
+	for name, p := range map[string]Proposer{"p1": p1, "p2": p2} {
+		for key, val := range values {
+			if state, err := p.Propose(ctx, key, changeFuncRead); err != nil {
+				t.Errorf("read %s via %s: %v", key, name, err)
+			} else if want, have := val, string(state); want != have {
+				t.Errorf("read %s via %s: want %q, have %q", key, name, want, have)
+			}
+		}
+	}
+}
+
+func TestChangeConfigurationTransitionWindow(t *testing.T) {
+	// Build the cluster.
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = NewMemoryAcceptor("4")
+		a5     = NewMemoryAcceptor("5")
+		a6     = NewMemoryAcceptor("6")
+		next   = []Acceptor{a4, a5, a6}
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+		ctx    = context.Background()
+		key    = "k"
+	)
+
+	// Each step writes a new value through one proposer, and expects to read
+	// it through the other, which is in a different configuration.
+	var step int
+	writeRead := func(w, r *LocalProposer) {
+		step++
+		val := []byte{'a' + byte(step)}
+		if _, err := w.Propose(ctx, key, func([]byte) []byte { return val }); err != nil {
+			t.Fatalf("step %d: write: %v", step, err)
+		}
+		if state, err := r.Propose(ctx, key, changeFuncRead); err != nil {
+			t.Fatalf("step %d: read: %v", step, err)
+		} else if want, have := string(val), string(state); want != have {
+			t.Fatalf("step %d: read: want %q, have %q", step, want, have)
+		}
+	}
+
+	// p1 joint, p2 old.
+	if err := p1.EnterJoint(next); err != nil {
+		t.Fatal(err)
+	}
+	writeRead(p1, p2)
+	writeRead(p2, p1)
+
+	// Both joint.
+	if err := p2.EnterJoint(next); err != nil {
+		t.Fatal(err)
+	}
+	writeRead(p1, p2)
+	writeRead(p2, p1)
+
+	// p1 new, p2 joint. The last write was made under the joint
+	// configuration, so it's been migrated.
+	if err := p1.CommitJoint(); err != nil {
+		t.Fatal(err)
+	}
+	writeRead(p1, p2)
+	writeRead(p2, p1)
+
+	// Both new.
+	if err := p2.CommitJoint(); err != nil {
+		t.Fatal(err)
+	}
+	writeRead(p1, p2)
+	writeRead(p2, p1)
+
+	// The old acceptors must not have seen any writes made after both
+	// proposers committed.
+	if want, have := "g", string(a1.dumpValue(key)); have > want {
+		t.Errorf("old acceptor: want at most %q, have %q", want, have)
+	}
+}
+
+func TestChangeConfigurationAbort(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("4")}
+		a5     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("5")}
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		ctx    = context.Background()
+	)
+	p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("v"))
+
+	// The next configuration is unreachable, so the change must fail, and
+	// leave the proposer in its original configuration.
+	a4.setFailing(true)
+	a5.setFailing(true)
+	if err := ChangeConfiguration(ctx, []Acceptor{a4, a5}, []string{"k"}, p1); err == nil {
+		t.Fatal("change configuration: want error, have none")
+	}
+	if err := p1.CommitJoint(); err != ErrNoJoint {
+		t.Fatalf("commit after failed change: want %v, have %v", ErrNoJoint, err)
+	}
+	if state, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatalf("read after failed change: %v", err)
+	} else if want, have := "v", string(state); want != have {
+		t.Fatalf("read after failed change: want %q, have %q", want, have)
+	}
+}
+
+func TestAddRemoveAcceptor(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = NewMemoryAcceptor("4")
+		p1     = NewLocalProposer(1, logger, a1, a2, a3)
+		ctx    = context.Background()
+	)
+	if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Repeated changes are no-ops.
+	for i := 0; i < 2; i++ {
+		if err := p1.AddAcceptor(ctx, a4); err != nil {
+			t.Fatalf("AddAcceptor #%d: %v", i+1, err)
+		}
+		if err := p1.RemoveAcceptor(ctx, a1); err != nil {
+			t.Fatalf("RemoveAcceptor #%d: %v", i+1, err)
+		}
+	}
+	if _, ok := p1.preparers["4"]; !ok {
+		t.Errorf("added acceptor isn't a preparer")
+	}
+	if _, ok := p1.accepters["1"]; ok {
+		t.Errorf("removed acceptor is still an accepter")
+	}
+
+	// A read rewrites the value to the new configuration.
+	if state, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	} else if want, have := "x", string(state); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	// Interrupted changes are completed.
+	a5 := NewMemoryAcceptor("5")
+	if err := p1.AddAccepter(a5); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.AddAcceptor(ctx, a5); err != nil {
+		t.Fatalf("AddAcceptor after an interrupted grow: %v", err)
+	}
+	if want, have := 2, p1.has("5"); want != have {
+		t.Errorf("after an interrupted grow: want %d roles, have %d", want, have)
+	}
+	if err := p1.RemovePreparer(a2); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.RemoveAcceptor(ctx, a2); err != nil {
+		t.Fatalf("RemoveAcceptor after an interrupted shrink: %v", err)
+	}
+	if want, have := 0, p1.has("2"); want != have {
+		t.Errorf("after an interrupted shrink: want %d roles, have %d", want, have)
+	}
+
+	if state, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	} else if want, have := "x", string(state); want != have {
+		t.Errorf("after interrupted changes: want %q, have %q", want, have)
+	}
+}
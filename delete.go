@@ -0,0 +1,178 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Deleter models a proposer which can delete keys, and reclaim their storage
+// in the acceptors. Delete is a compare-and-swap: the key is only deleted if
+// its value is equal to current.
+type Deleter interface {
+	Delete(ctx context.Context, key string, current []byte) error
+}
+
+// Purger models an acceptor which can remove a deleted key. Purge removes the
+// key if its latest state is the tombstone accepted with the given ballot, or
+// if the key is already gone. Afterwards, the acceptor must reject prepares and
+// accepts for absent keys with ballots that aren't greater than the tombstone,
+// so that stale proposals can't resurrect the key; the rejection is an ordinary
+// ConflictError, so proposers fast-forward past the tombstone and retry.
+type Purger interface {
+	Purge(ctx context.Context, key string, tombstone Ballot) error
+}
+
+var (
+	// ErrPurgeUnsupported indicates that Delete was called on a proposer with
+	// an acceptor which doesn't implement Purger.
+	ErrPurgeUnsupported = errors.New("acceptor doesn't support purge")
+
+	// ErrNotTombstone is returned by Purge when the key's latest state isn't
+	// the tombstone, e.g. because it hasn't been replicated there yet.
+	ErrNotTombstone = errors.New("latest state isn't the tombstone")
+
+	// ErrValueMismatch is returned by Delete when the key's value isn't the
+	// expected current value, and so the key wasn't deleted.
+	ErrValueMismatch = errors.New("value doesn't match the expected current value")
+)
+
+// Delete implements Deleter, with the deletion process described in the paper.
+// First, a tombstone, which is the empty value, is written with an ordinary
+// proposal, if the key's value is equal to current, as with CompareAndSwap;
+// otherwise, Delete returns ErrValueMismatch, and the value is unchanged. From
+// then on, the key reads as empty. Second, the tombstone is replicated to
+// every acceptor, not just a quorum. Third, every acceptor purges the key, and
+// raises its watermark to the tombstone's ballot. The paper's remaining step,
+// fast-forwarding every proposer past the tombstone, happens on demand: an
+// acceptor rejects a stale proposal for a purged key, and its proposer
+// fast-forwards and retries.
+//
+// Every acceptor must implement Purger, and be reachable. If the second or
+// third step fails, e.g. because an acceptor is down, or the key is written
+// again concurrently, Delete returns an error, but it's safe to retry with the
+// same arguments: a key that's already missing or deleted matches any current
+// value, so the tombstone is simply written again. The key is only purged from
+// an acceptor once every acceptor holds the tombstone, so a purged acceptor is
+// indistinguishable from one with the tombstone.
+func (p *LocalProposer) Delete(ctx context.Context, key string, current []byte) error {
+	// Fail early, before the tombstone is written, if the key can't be purged.
+	// The accepters are checked again below, since they may change meanwhile.
+	p.mtx.RLock()
+	_, err := p.purgers()
+	p.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write the tombstone.
+	var mismatch bool
+	_, b, err := p.run(ctx, key, func(x []byte) []byte {
+		mismatch = x != nil && (current == nil || !bytes.Equal(x, current))
+		if mismatch {
+			return x
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if mismatch {
+		return ErrValueMismatch
+	}
+
+	// Replicate the tombstone to every accepter. Re-sending the accept with
+	// the same ballot completes the proposal's accept phase on the accepters
+	// which weren't part of its quorum.
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	purgers, err := p.purgers()
+	if err != nil {
+		return err
+	}
+	if err := p.everyAccepter(func(addr string, target Accepter) error {
+		return target.Accept(ctx, key, b, nil)
+	}); err != nil {
+		return fmt.Errorf("replicating tombstone: %v", err)
+	}
+
+	// Purge the key.
+	if err := p.everyAccepter(func(addr string, target Accepter) error {
+		return purgers[addr].Purge(ctx, key, b)
+	}); err != nil {
+		return fmt.Errorf("purging: %v", err)
+	}
+	return nil
+}
+
+// purgers returns every accepter as a Purger, if they all are, and the
+// configuration is stable enough to delete keys. The caller must hold the
+// mutex.
+func (p *LocalProposer) purgers() (map[string]Purger, error) {
+	for addr := range p.preparers {
+		if _, ok := p.accepters[addr]; !ok {
+			return nil, ErrConfigurationInFlux
+		}
+	}
+	purgers := make(map[string]Purger, len(p.accepters))
+	for addr, target := range p.accepters {
+		purger, ok := target.(Purger)
+		if !ok {
+			return nil, ErrPurgeUnsupported
+		}
+		purgers[addr] = purger
+	}
+	return purgers, nil
+}
+
+// everyAccepter calls f for every accepter concurrently, and succeeds only if
+// every call does. The caller must hold the mutex.
+func (p *LocalProposer) everyAccepter(f func(addr string, target Accepter) error) error {
+	type result struct {
+		addr string
+		err  error
+	}
+	results := make(chan result, len(p.accepters))
+	for addr, target := range p.accepters {
+		go func(addr string, target Accepter) {
+			results <- result{addr, f(addr, target)}
+		}(addr, target)
+	}
+	var failed []string
+	for range p.accepters {
+		if r := <-results; r.err != nil {
+			p.countAcceptorError(r.err)
+			failed = append(failed, fmt.Sprintf("%s: %v", r.addr, r.err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// purge checks whether a key with state av can be purged, given the ballot of
+// its tombstone.
+func (av acceptedValue) purge(tombstone Ballot) error {
+	if av.promise.greaterThan(tombstone) {
+		return ConflictError{Proposed: tombstone, Existing: av.promise}
+	}
+	if av.accepted.greaterThan(tombstone) {
+		return ConflictError{Proposed: tombstone, Existing: av.accepted}
+	}
+	if av.accepted != tombstone || av.value != nil {
+		return ErrNotTombstone
+	}
+	return nil
+}
+
+// belowWatermark returns a ConflictError if a proposal for an absent key must
+// be rejected, because its ballot isn't greater than the acceptor's watermark.
+func belowWatermark(watermark, b Ballot) error {
+	if !watermark.isZero() && !b.greaterThan(watermark) {
+		return ConflictError{Proposed: b, Existing: watermark}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package caspaxos
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	_ Deleter = (*LocalProposer)(nil)
+	_ Purger  = (*MemoryAcceptor)(nil)
+	_ Purger  = (*TieredAcceptor)(nil)
+	_ Purger  = (*DiskAcceptor)(nil)
+)
+
+func TestDelete(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		ctx    = context.Background()
+		mtx    sync.Mutex
+		events = map[KeyEvent]int{}
+		count  = func(key string, e KeyEvent) { mtx.Lock(); events[e]++; mtx.Unlock() }
+		a1     = NewMemoryAcceptor("1", AcceptorOnKeyEvent(count))
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+	)
+
+	// Drive p1's ballot well ahead of p2's.
+	for i := 0; i < 10; i++ {
+		if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := ErrValueMismatch, p1.Delete(ctx, "k", []byte("other")); want != have {
+		t.Fatalf("Delete with the wrong value: want %v, have %v", want, have)
+	}
+	if value, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	} else if want, have := "x", string(value); want != have {
+		t.Fatalf("after Delete with the wrong value: want %q, have %q", want, have)
+	}
+	if err := p1.Delete(ctx, "k", []byte("x")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// Every acceptor has forgotten the key.
+	for _, a := range []*MemoryAcceptor{a1, a2, a3} {
+		s := a.shard("k")
+		if _, ok := s.values["k"]; ok {
+			t.Errorf("acceptor %s: key wasn't purged", a.Address())
+		}
+	}
+	mtx.Lock()
+	if want, have := 1, events[KeyTombstoned]; want != have {
+		t.Errorf("tombstoned events: want %d, have %d", want, have)
+	}
+	if want, have := 1, events[KeyPurged]; want != have {
+		t.Errorf("purged events: want %d, have %d", want, have)
+	}
+	mtx.Unlock()
+
+	// Deleting it again, e.g. a retry, is fine.
+	if err := p1.Delete(ctx, "k", []byte("x")); err != nil {
+		t.Fatalf("repeated Delete: %v", err)
+	}
+
+	// A stale ballot can't resurrect the key.
+	if err := a1.Accept(ctx, "k", Ballot{Counter: 1, ID: 2}, []byte("zombie")); err == nil {
+		t.Errorf("stale accept after purge: want conflict, have none")
+	}
+
+	// But a proposer with a stale ballot fast-forwards past the tombstone, and
+	// can write the key again.
+	value, err := p2.Propose(ctx, "k", changeFuncInitializeOnlyOnce("y"))
+	if err != nil {
+		t.Fatalf("write after delete: %v", err)
+	}
+	if want, have := "y", string(value); want != have {
+		t.Errorf("write after delete: want %q, have %q", want, have)
+	}
+
+	// Deleting a key that was never written is fine.
+	if err := p2.Delete(ctx, "missing", nil); err != nil {
+		t.Errorf("Delete of missing key: %v", err)
+	}
+}
+
+func TestDeleteUnsupported(t *testing.T) {
+	type plainAcceptor struct{ Acceptor }
+	var (
+		a1 = plainAcceptor{NewMemoryAcceptor("1")}
+		p1 = NewLocalProposer(1, nil, a1)
+	)
+	if want, have := ErrPurgeUnsupported, p1.Delete(context.Background(), "k", nil); want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestDeleteMembershipChange(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		armed int32
+		a1    = &interceptAcceptor{MemoryAcceptor: NewMemoryAcceptor("1")}
+		a2    = NewMemoryAcceptor("2")
+		p1    = NewLocalProposer(1, nil, a1)
+		added = make(chan error, 1)
+	)
+
+	// While the tombstone is being written, add an accepter. The proposal
+	// holds the read lock, so the change waits for it, and lands between the
+	// tombstone and the purge.
+	a1.afterAccept = func(string) {
+		if !atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			return
+		}
+		go func() { added <- p1.AddAccepter(a2) }()
+		for p1.mtx.TryRLock() { // until the change is waiting for the lock
+			p1.mtx.RUnlock()
+			runtime.Gosched()
+		}
+	}
+	if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&armed, 1)
+	if err := p1.Delete(ctx, "k", []byte("x")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+
+	// The new accepter took part in the replication and the purge.
+	for _, a := range []*MemoryAcceptor{a1.MemoryAcceptor, a2} {
+		s := a.shard("k")
+		if _, ok := s.values["k"]; ok {
+			t.Errorf("acceptor %s: key wasn't purged", a.Address())
+		}
+		if s.watermark.isZero() {
+			t.Errorf("acceptor %s: watermark wasn't raised", a.Address())
+		}
+	}
+}
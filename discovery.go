@@ -0,0 +1,182 @@
+package caspaxos
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Resolver models the subset of net.Resolver used for discovery.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// DialFunc returns an Acceptor for the given network address (host:port).
+// Typically it constructs a client for some transport.
+type DialFunc func(addr string) (Acceptor, error)
+
+// ErrNoRecords indicates a DNS name resolved to zero addresses.
+var ErrNoRecords = errors.New("no records")
+
+// DNSDiscovery keeps the acceptor set of one or more proposers in sync with
+// the A/AAAA records of a DNS name, for environments where acceptors sit
+// behind e.g. a headless service and gossip isn't available. It's an
+// alternative to specifying the acceptors directly.
+//
+// The first successful resolution sets the proposers' acceptors directly, so
+// the proposers should start without any. Subsequent changes are applied one
+// acceptor at a time, via GrowCluster and ShrinkCluster. Failed and empty
+// resolutions are ignored, so a DNS outage can't empty the cluster.
+type DNSDiscovery struct {
+	name      string
+	port      string
+	dial      DialFunc
+	proposers []Proposer
+	resolver  Resolver
+	interval  time.Duration
+	logger    Logger
+
+	mtx     sync.Mutex
+	current map[string]Acceptor
+}
+
+// DNSDiscoveryOption sets an optional parameter for DNSDiscovery.
+type DNSDiscoveryOption func(*DNSDiscovery)
+
+// DNSDiscoveryResolver sets the resolver. By default, net.DefaultResolver.
+func DNSDiscoveryResolver(r Resolver) DNSDiscoveryOption {
+	return func(d *DNSDiscovery) { d.resolver = r }
+}
+
+// DNSDiscoveryInterval sets how often Run re-resolves the name.
+// By default, 30 seconds.
+func DNSDiscoveryInterval(interval time.Duration) DNSDiscoveryOption {
+	return func(d *DNSDiscovery) { d.interval = interval }
+}
+
+// DNSDiscoveryLogger sets the logger. By default, nothing is logged.
+func DNSDiscoveryLogger(logger Logger) DNSDiscoveryOption {
+	return func(d *DNSDiscovery) { d.logger = logger }
+}
+
+// NewDNSDiscovery returns a DNSDiscovery which resolves name, and dials every
+// resulting address on the given port to produce an acceptor.
+func NewDNSDiscovery(name, port string, dial DialFunc, proposers []Proposer, options ...DNSDiscoveryOption) *DNSDiscovery {
+	d := &DNSDiscovery{
+		name:      name,
+		port:      port,
+		dial:      dial,
+		proposers: proposers,
+		resolver:  net.DefaultResolver,
+		interval:  30 * time.Second,
+		logger:    NopLogger(),
+		current:   map[string]Acceptor{},
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// Run refreshes the acceptor set immediately, and then periodically, until
+// the context is canceled. Refresh errors are logged, not returned.
+func (d *DNSDiscovery) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Refresh(ctx); err != nil {
+			d.logger.Log(LevelKey, LevelWarn, "name", d.name, "during", "refresh", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// anyBootstrapped returns true if any of the proposers may have served a
+// proposal. Proposers without a Bootstrapped method are assumed to have.
+func anyBootstrapped(proposers []Proposer) bool {
+	for _, p := range proposers {
+		b, ok := p.(interface{ Bootstrapped() bool })
+		if !ok || b.Bootstrapped() {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh resolves the name once, and brings the proposers' acceptor set in
+// line with the result.
+func (d *DNSDiscovery) Refresh(ctx context.Context) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	hosts, err := d.resolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return ErrNoRecords
+	}
+
+	want := map[string]bool{}
+	for _, host := range hosts {
+		want[net.JoinHostPort(host, d.port)] = true
+	}
+
+	var add, remove []string
+	for addr := range want {
+		if _, ok := d.current[addr]; !ok {
+			add = append(add, addr)
+		}
+	}
+	for addr := range d.current {
+		if !want[addr] {
+			remove = append(remove, addr)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+
+	// With no acceptors, there's no state to preserve, and GrowCluster's
+	// identity read couldn't succeed anyway. So, bootstrap directly. The same
+	// goes for proposers which are still waiting for their minimum number of
+	// acceptors, and so haven't served any proposals.
+	bootstrap := len(d.current) == 0 || !anyBootstrapped(d.proposers)
+
+	for _, addr := range add {
+		target, err := d.dial(addr)
+		if err != nil {
+			return err
+		}
+		if bootstrap {
+			for _, p := range d.proposers {
+				if err := p.AddAccepter(target); err != nil && err != ErrDuplicate {
+					return err
+				}
+				if err := p.AddPreparer(target); err != nil && err != ErrDuplicate {
+					return err
+				}
+			}
+		} else if err := GrowCluster(ctx, target, d.proposers...); err != nil {
+			return err
+		}
+		d.current[addr] = target
+		d.logger.Log(LevelKey, LevelInfo, "name", d.name, "acceptor", addr, "op", "add")
+	}
+
+	for _, addr := range remove {
+		if err := ShrinkCluster(ctx, d.current[addr], d.proposers...); err != nil {
+			return err
+		}
+		delete(d.current, addr)
+		d.logger.Log(LevelKey, LevelInfo, "name", d.name, "acceptor", addr, "op", "remove")
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package caspaxos
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDNSDiscovery(t *testing.T) {
+	var (
+		logger    = log.NewLogfmtLogger(testWriter{t})
+		p1        = NewLocalProposer(1, log.With(logger, "p", 1))
+		p2        = NewLocalProposer(2, log.With(logger, "p", 2))
+		resolver  = &fakeResolver{}
+		acceptors = map[string]*MemoryAcceptor{}
+		dial      = func(addr string) (Acceptor, error) {
+			a := NewMemoryAcceptor(addr)
+			acceptors[addr] = a
+			return a, nil
+		}
+		discovery = NewDNSDiscovery("acceptors.local", "8080", dial, []Proposer{p1, p2},
+			DNSDiscoveryResolver(resolver),
+			DNSDiscoveryLogger(log.With(logger, "component", "discovery")),
+		)
+		ctx      = context.Background()
+		key, val = "k", "v"
+	)
+
+	// The first resolution bootstraps the cluster.
+	resolver.set("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	if err := discovery.Refresh(ctx); err != nil {
+		t.Fatalf("initial refresh: %v", err)
+	}
+	if _, err := p1.Propose(ctx, key, changeFuncInitializeOnlyOnce(val)); err != nil {
+		t.Fatalf("initial write: %v", err)
+	}
+
+	// Failed or empty resolutions don't change anything.
+	resolver.set()
+	if want, have := ErrNoRecords, discovery.Refresh(ctx); want != have {
+		t.Fatalf("empty refresh: want %v, have %v", want, have)
+	}
+
+	// A new record grows the cluster.
+	resolver.set("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	if err := discovery.Refresh(ctx); err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+
+	// A removed record shrinks the cluster.
+	resolver.set("10.0.0.2", "10.0.0.3", "10.0.0.4")
+	if err := discovery.Refresh(ctx); err != nil {
+		t.Fatalf("shrink: %v", err)
+	}
+	for name, p := range map[string]Proposer{"p1": p1, "p2": p2} {
+		if err := p.RemoveAccepter(acceptors["10.0.0.1:8080"]); err != ErrNotFound {
+			t.Errorf("%s: removed acceptor is still an accepter", name)
+		}
+		if state, err := p.Propose(ctx, key, changeFuncRead); err != nil {
+			t.Errorf("read via %s: %v", name, err)
+		} else if want, have := val, string(state); want != have {
+			t.Errorf("read via %s: want %q, have %q", name, want, have)
+		}
+	}
+
+	// After a few reads, the new acceptor should have the value. Propose
+	// returns once a quorum has accepted, so the accept to the new acceptor
+	// may still be in flight.
+	var (
+		a4       = acceptors["10.0.0.4:8080"]
+		deadline = time.Now().Add(5 * time.Second)
+	)
+	for string(a4.dumpValue(key)) != val && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if want, have := val, string(a4.dumpValue(key)); want != have {
+		t.Errorf("new acceptor: want %q, have %q", want, have)
+	}
+}
+
+func TestDNSDiscoveryMinAcceptors(t *testing.T) {
+	var (
+		logger    = log.NewLogfmtLogger(testWriter{t})
+		p1        = NewLocalProposerWithOptions(1, logger, nil, ProposerMinAcceptors(3))
+		resolver  = &fakeResolver{}
+		dial      = func(addr string) (Acceptor, error) { return NewMemoryAcceptor(addr), nil }
+		discovery = NewDNSDiscovery("acceptors.local", "8080", dial, []Proposer{p1}, DNSDiscoveryResolver(resolver))
+		ctx       = context.Background()
+	)
+
+	// Only one acceptor is visible at first, so the proposer refuses to serve.
+	resolver.set("10.0.0.1")
+	if err := discovery.Refresh(ctx); err != nil {
+		t.Fatalf("first refresh: %v", err)
+	}
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != ErrBootstrapping {
+		t.Fatalf("with one acceptor: want %v, have %v", ErrBootstrapping, err)
+	}
+
+	// The rest are added directly, since nothing can have been written.
+	resolver.set("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	if err := discovery.Refresh(ctx); err != nil {
+		t.Fatalf("second refresh: %v", err)
+	}
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatalf("with three acceptors: %v", err)
+	}
+
+	// Once bootstrapped, losing an acceptor doesn't stop the proposer.
+	resolver.set("10.0.0.1", "10.0.0.2")
+	if err := discovery.Refresh(ctx); err != nil {
+		t.Fatalf("third refresh: %v", err)
+	}
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatalf("after shrinking: %v", err)
+	}
+}
+
+type fakeResolver struct {
+	mtx   sync.Mutex
+	hosts []string
+}
+
+func (r *fakeResolver) set(hosts ...string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.hosts = hosts
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.hosts, nil
+}
+
+var _ Resolver = (*net.Resolver)(nil)
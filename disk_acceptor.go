@@ -0,0 +1,505 @@
+package caspaxos
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DiskAcceptor persists data to a write-ahead log on disk, so its promises and
+// accepted values survive a crash or restart. CASPaxos requires this for
+// safety: an acceptor which forgets a promise may confirm a lesser ballot, and
+// allow two different values to be chosen. Every change is fsynced before
+// it's acknowledged. The whole state is also kept in memory, for reads.
+//
+// The log is an append-only sequence of records, each holding the complete
+// state of one key, or the purge of a key, with a checksum. On startup, the
+// log is replayed, and the last record for each key wins. A torn or corrupt
+// record at the end of the log, left by a crash during a write, was never
+// acknowledged, so it's discarded. But a corrupt record followed by intact
+// ones can't be explained by a crash, and discarding the intact records could
+// lose acknowledged promises, so NewDiskAcceptor refuses to start instead.
+// Once the log has grown to several times the size of the current state, it's
+// compacted, by writing the current state to a new log which replaces the old
+// one.
+type DiskAcceptor struct {
+	mtx        sync.Mutex
+	addr       string
+	dir        string
+	file       *os.File
+	size       int64 // bytes in the log
+	live       int64 // bytes in the last record for each key
+	compactMin int64
+	failed     error    // set if the log can't be repaired after a failed write
+	lock       *os.File // held until Close
+	values     map[string]acceptedValue
+	watermark  Ballot // greatest tombstone purged
+	chosen     ChosenFunc
+	events     keyEvents
+
+	prepares    Counter
+	accepts     Counter
+	keys        Gauge
+	logBytes    Gauge
+	compactions Counter
+}
+
+const (
+	diskLogName  = "caspaxos.log"
+	diskLockName = "caspaxos.lock"
+
+	// The log isn't compacted until it's at least this big, and this many
+	// times the size of the current state.
+	diskCompactMin    = 4 << 20
+	diskCompactFactor = 4
+)
+
+var errDiskCorrupt = errors.New("corrupt log record")
+
+// ErrDirLocked is returned by NewDiskAcceptor when another acceptor, in this
+// or another process, is using the directory.
+var ErrDirLocked = errors.New("directory is in use by another acceptor")
+
+// NewDiskAcceptor returns an acceptor which keeps its log in dir, creating the
+// directory if necessary, and recovers the state from any existing log. Only
+// one acceptor may use a directory at a time; the directory is locked until
+// Close, and if it's already locked, NewDiskAcceptor returns ErrDirLocked.
+func NewDiskAcceptor(addr, dir string, options ...AcceptorOption) (*DiskAcceptor, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	o := makeAcceptorOptions(options)
+	a := &DiskAcceptor{
+		addr:        addr,
+		dir:         dir,
+		lock:        lock,
+		compactMin:  diskCompactMin,
+		values:      map[string]acceptedValue{},
+		chosen:      o.onChosen,
+		events:      o.keyEvents(),
+		prepares:    o.metrics.Counter("prepares"),
+		accepts:     o.metrics.Counter("accepts"),
+		keys:        o.metrics.Gauge("keys"),
+		logBytes:    o.metrics.Gauge("log_bytes"),
+		compactions: o.metrics.Counter("compactions"),
+	}
+	if err := a.recover(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Address implements Addresser.
+func (a *DiskAcceptor) Address() string {
+	return a.addr
+}
+
+// Prepare implements the first-phase responsibilities of an acceptor.
+// A new promise is persisted before it's returned.
+func (a *DiskAcceptor) Prepare(ctx context.Context, key string, b Ballot) (value []byte, current Ballot, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, zeroballot, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.failed != nil {
+		return nil, zeroballot, a.failed
+	}
+
+	av, ok := a.values[key]
+	if !ok {
+		if err := belowWatermark(a.watermark, b); err != nil {
+			a.prepares.With("result", "conflict").Add(1)
+			return nil, a.watermark, err
+		}
+	}
+	prev := av
+	if current, err = av.prepare(b); err != nil {
+		a.prepares.With("result", "conflict").Add(1)
+		return av.value, current, err
+	}
+	if av.promise != prev.promise {
+		if err := a.persist(key, av); err != nil {
+			return nil, zeroballot, err
+		}
+	}
+
+	a.prepares.With("result", "confirm").Add(1)
+	return av.value, current, nil
+}
+
+// Accept implements the second-phase responsibilities of an acceptor.
+// The accepted value is persisted before Accept returns.
+func (a *DiskAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.failed != nil {
+		return a.failed
+	}
+
+	av, ok := a.values[key]
+	if !ok {
+		if err := belowWatermark(a.watermark, b); err != nil {
+			a.accepts.With("result", "conflict").Add(1)
+			return err
+		}
+	}
+	prev := av
+	if err := av.accept(b, value); err != nil {
+		a.accepts.With("result", "conflict").Add(1)
+		return err
+	}
+	if err := a.persist(key, av); err != nil {
+		return err
+	}
+
+	a.accepts.With("result", "confirm").Add(1)
+	a.events.accepted(key, prev, value)
+	a.chosen(key, b, value)
+	return nil
+}
+
+// Purge implements Purger. The purge is persisted before Purge returns.
+func (a *DiskAcceptor) Purge(ctx context.Context, key string, tombstone Ballot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.failed != nil {
+		return a.failed
+	}
+
+	av, ok := a.values[key]
+	if !ok {
+		return nil
+	}
+	if err := av.purge(tombstone); err != nil {
+		return err
+	}
+	if err := a.append(encodeDiskRecord(diskRecordPurge, key, acceptedValue{accepted: tombstone})); err != nil {
+		return err
+	}
+
+	a.remove(key, av)
+	a.raiseWatermark(tombstone)
+	a.events.purged(key)
+	a.maybeCompact()
+	return nil
+}
+
+// Accepted implements AcceptedReader. It's served from memory.
+func (a *DiskAcceptor) Accepted(ctx context.Context, key string) (value []byte, accepted Ballot, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, zeroballot, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.failed != nil {
+		return nil, zeroballot, a.failed
+	}
+
+	av := a.values[key]
+	return av.value, av.accepted, nil
+}
+
+// Close closes the log, and unlocks the directory. The acceptor shouldn't be
+// used afterwards.
+func (a *DiskAcceptor) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	err := a.file.Close()
+	a.lock.Close()
+	return err
+}
+
+// recover replays the log into memory, discards a torn or corrupt record at
+// the end of it, and opens it for appending. It fails if a corrupt record is
+// followed by an intact one.
+func (a *DiskAcceptor) recover() error {
+	// A leftover temporary file is from a compaction that didn't complete, so
+	// the log it was meant to replace is still intact.
+	os.Remove(filepath.Join(a.dir, diskLogName+".tmp"))
+
+	filename := filepath.Join(a.dir, diskLogName)
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var offset int
+	for offset < len(buf) {
+		kind, key, av, n, err := decodeDiskRecord(buf[offset:])
+		if err != nil {
+			if intactRecordAfter(buf, offset) {
+				return fmt.Errorf("%s: %v at offset %d, followed by intact records", filename, err, offset)
+			}
+			break
+		}
+		switch kind {
+		case diskRecordValue:
+			a.store(key, av)
+		case diskRecordPurge:
+			if prev, ok := a.values[key]; ok {
+				a.remove(key, prev)
+			}
+			a.raiseWatermark(av.accepted)
+		case diskRecordWatermark:
+			a.raiseWatermark(av.accepted)
+		}
+		offset += n
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if offset < len(buf) {
+		if err := f.Truncate(int64(offset)); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if buf == nil {
+		// The log was just created, so make sure its directory entry is
+		// durable, too.
+		if err := syncDir(a.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	a.file, a.size = f, int64(offset)
+	a.keys.Set(float64(len(a.values)))
+	a.logBytes.Set(float64(a.size))
+	return nil
+}
+
+// intactRecordAfter returns true if a record decodes successfully anywhere in
+// buf after offset. Records aren't aligned, so every offset is tried.
+func intactRecordAfter(buf []byte, offset int) bool {
+	for o := offset + 1; o+diskRecordHeader <= len(buf); o++ {
+		if _, _, _, _, err := decodeDiskRecord(buf[o:]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// persist appends a record of the key's new state to the log, and syncs it,
+// before updating the state in memory. The caller must hold the mutex.
+func (a *DiskAcceptor) persist(key string, av acceptedValue) error {
+	if err := a.append(encodeDiskRecord(diskRecordValue, key, av)); err != nil {
+		return err
+	}
+	a.store(key, av)
+	a.maybeCompact()
+	return nil
+}
+
+// append writes the record to the end of the log, and syncs it.
+func (a *DiskAcceptor) append(rec []byte) error {
+	if _, err := a.file.Write(rec); err != nil {
+		return a.repair(err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return a.repair(err)
+	}
+	a.size += int64(len(rec))
+	a.logBytes.Set(float64(a.size))
+	return nil
+}
+
+// store updates the state of key in memory, and the size of the live state.
+func (a *DiskAcceptor) store(key string, av acceptedValue) {
+	if prev, ok := a.values[key]; ok {
+		a.live -= int64(diskRecordSize(key, prev))
+	}
+	a.values[key] = av
+	a.live += int64(diskRecordSize(key, av))
+	a.keys.Set(float64(len(a.values)))
+}
+
+// remove forgets the key, whose current state is av.
+func (a *DiskAcceptor) remove(key string, av acceptedValue) {
+	delete(a.values, key)
+	a.live -= int64(diskRecordSize(key, av))
+	a.keys.Set(float64(len(a.values)))
+}
+
+// raiseWatermark raises the watermark to b, if it's greater. A non-zero
+// watermark is part of the live state, as a record of its own.
+func (a *DiskAcceptor) raiseWatermark(b Ballot) {
+	if !b.greaterThan(a.watermark) {
+		return
+	}
+	if a.watermark.isZero() {
+		a.live += int64(diskRecordSize("", acceptedValue{}))
+	}
+	a.watermark = b
+}
+
+// repair truncates a partially written record from the end of the log, so
+// subsequent records aren't lost behind it during recovery. If that fails,
+// the acceptor refuses all further requests. It returns the original error.
+func (a *DiskAcceptor) repair(err error) error {
+	if terr := a.file.Truncate(a.size); terr != nil {
+		a.failed = terr
+	}
+	return err
+}
+
+// maybeCompact compacts the log, if it's big enough to be worth it. The caller
+// must hold the mutex.
+func (a *DiskAcceptor) maybeCompact() {
+	if a.size < a.compactMin || a.size < diskCompactFactor*a.live {
+		return
+	}
+	a.compact() // best effort; if it fails, the old log is still valid
+}
+
+// compact replaces the log with one holding only the current state. The
+// caller must hold the mutex.
+func (a *DiskAcceptor) compact() error {
+	var (
+		filename = filepath.Join(a.dir, diskLogName)
+		tmp      = filename + ".tmp"
+	)
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if !a.watermark.isZero() {
+		if _, err := w.Write(encodeDiskRecord(diskRecordWatermark, "", acceptedValue{accepted: a.watermark})); err != nil {
+			return abort(err)
+		}
+	}
+	for key, av := range a.values {
+		if _, err := w.Write(encodeDiskRecord(diskRecordValue, key, av)); err != nil {
+			return abort(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return abort(err)
+	}
+	if err := f.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return abort(err)
+	}
+
+	// The new log is in place, so it must be used from now on, even if the
+	// rename can't be synced.
+	a.file.Close()
+	a.file, a.size = f, a.live
+	a.logBytes.Set(float64(a.size))
+	a.compactions.Add(1)
+	return syncDir(a.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (a *DiskAcceptor) dumpValue(key string) []byte {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	av := a.values[key]
+	dst := make([]byte, len(av.value))
+	copy(dst, av.value)
+	return dst
+}
+
+// A log record is the length of the payload, its CRC-32 (Castagnoli), and the
+// payload, which is the kind of record, and a key's state as encoded by
+// encodeAcceptedValue. A value record holds the key's new state. A purge
+// record holds the tombstone's ballot as the accepted ballot, and a watermark
+// record holds the watermark the same way, with an empty key.
+const (
+	diskRecordHeader = 4 + 4
+
+	diskRecordValue     byte = 0
+	diskRecordPurge     byte = 1
+	diskRecordWatermark byte = 2
+)
+
+var diskCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeDiskRecord(kind byte, key string, av acceptedValue) []byte {
+	payload := append([]byte{kind}, encodeAcceptedValue(key, av)...)
+	buf := make([]byte, 0, diskRecordHeader+len(payload))
+	buf = appendUint32(buf, uint32(len(payload)))
+	buf = appendUint32(buf, crc32.Checksum(payload, diskCRCTable))
+	return append(buf, payload...)
+}
+
+func diskRecordSize(key string, av acceptedValue) int {
+	return diskRecordHeader + 1 + encodedAcceptedValueSize(key, av)
+}
+
+// decodeDiskRecord decodes the record at the start of buf, and returns its
+// size in bytes.
+func decodeDiskRecord(buf []byte) (kind byte, key string, av acceptedValue, n int, err error) {
+	if len(buf) < diskRecordHeader {
+		return kind, key, av, 0, errDiskCorrupt
+	}
+	size := int(binary.BigEndian.Uint32(buf))
+	if len(buf) < diskRecordHeader+size {
+		return kind, key, av, 0, errDiskCorrupt
+	}
+	payload := buf[diskRecordHeader : diskRecordHeader+size]
+	if crc32.Checksum(payload, diskCRCTable) != binary.BigEndian.Uint32(buf[4:]) {
+		return kind, key, av, 0, errDiskCorrupt
+	}
+	if len(payload) < 1+4 {
+		return kind, key, av, 0, errDiskCorrupt
+	}
+	kind, payload = payload[0], payload[1:]
+	if kind > diskRecordWatermark || len(payload) < 4+int(binary.BigEndian.Uint32(payload)) {
+		return kind, key, av, 0, errDiskCorrupt
+	}
+	key = string(payload[4 : 4+binary.BigEndian.Uint32(payload)])
+	if av, err = decodeAcceptedValue(key, payload); err != nil {
+		return kind, key, av, 0, err
+	}
+	return kind, key, av, diskRecordHeader + size, nil
+}
@@ -0,0 +1,246 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var _ Acceptor = (*DiskAcceptor)(nil)
+
+func TestDiskAcceptorRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx = context.Background()
+		b1  = Ballot{Counter: 1, ID: 1}
+		b2  = Ballot{Counter: 2, ID: 1}
+		b3  = Ballot{Counter: 3, ID: 1}
+	)
+	a, err := NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Prepare(ctx, "k", b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Accept(ctx, "k", b1, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Prepare(ctx, "k", b3); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// Simulate a crash partway through writing a record.
+	f, err := os.OpenFile(filepath.Join(dir, diskLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeDiskRecord(diskRecordValue, "k", acceptedValue{accepted: b3, value: []byte("torn")})[:20])
+	f.Close()
+
+	// After a restart, the promise and the accepted value survive, and the
+	// torn record is discarded.
+	a, err = NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Prepare(ctx, "k", b2); err == nil {
+		t.Errorf("Prepare(%s) after restart: want conflict with promise %s, have none", b2, b3)
+	}
+	if want, have := "x", string(a.dumpValue("k")); want != have {
+		t.Errorf("after restart: want %q, have %q", want, have)
+	}
+
+	// Records written after the repair survive another restart.
+	if err := a.Accept(ctx, "k", b3, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	a, err = NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if want, have := "y", string(a.dumpValue("k")); want != have {
+		t.Errorf("after second restart: want %q, have %q", want, have)
+	}
+}
+
+func TestDiskAcceptorCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	a, err := NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := a.Accept(ctx, fmt.Sprintf("k%d", i), Ballot{Counter: uint64(i), ID: 1}, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	// Corrupt the first record. The records after it are intact, so this
+	// isn't a torn write, and the acceptor mustn't start.
+	filename := filepath.Join(dir, diskLogName)
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[diskRecordHeader+2] ^= 0xff
+	if err := ioutil.WriteFile(filename, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := NewDiskAcceptor("1", dir); err == nil {
+		a.Close()
+		t.Fatal("want error, have none")
+	}
+
+	// The log is left as it was, for an operator to inspect.
+	after, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := len(buf), len(after); want != have {
+		t.Errorf("log size: want %d, have %d", want, have)
+	}
+}
+
+func TestDiskAcceptorLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskAcceptor("2", dir); err != ErrDirLocked {
+		t.Fatalf("second acceptor: want %v, have %v", ErrDirLocked, err)
+	}
+
+	// The directory is unlocked by Close.
+	a.Close()
+	a, err = NewDiskAcceptor("2", dir)
+	if err != nil {
+		t.Fatalf("after Close: %v", err)
+	}
+	a.Close()
+}
+
+func TestDiskAcceptorCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx = context.Background()
+		m   = newTestMetrics()
+	)
+	a, err := NewDiskAcceptor("1", dir, AcceptorMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.compactMin = 0
+
+	// Rewriting the same keys grows the log, until it's compacted.
+	for i := 1; i <= 100; i++ {
+		b := Ballot{Counter: uint64(i), ID: 1}
+		if err := a.Accept(ctx, fmt.Sprintf("k%d", i%3), b, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.value("compactions") == 0 {
+		t.Fatal("log was never compacted")
+	}
+	if a.size > diskCompactFactor*a.live {
+		t.Errorf("log size %d exceeds %d times live size %d", a.size, diskCompactFactor, a.live)
+	}
+	info, err := os.Stat(filepath.Join(dir, diskLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := a.size, info.Size(); want != have {
+		t.Errorf("log size: want %d, have %d", want, have)
+	}
+	a.Close()
+
+	// The compacted log holds the latest state.
+	a, err = NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for key, want := range map[string]string{"k0": "99", "k1": "100", "k2": "98"} {
+		if have := string(a.dumpValue(key)); want != have {
+			t.Errorf("%s: want %q, have %q", key, want, have)
+		}
+	}
+}
+
+func TestDiskAcceptorPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx       = context.Background()
+		tombstone = Ballot{Counter: 5, ID: 1}
+		stale     = Ballot{Counter: 4, ID: 2}
+	)
+	a, err := NewDiskAcceptor("1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Accept(ctx, "k", Ballot{Counter: 1, ID: 1}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Accept(ctx, "k", tombstone, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Purge(ctx, "k", tombstone); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// The purge and the watermark survive a restart, and then a compaction
+	// and another restart.
+	for _, compact := range []bool{true, false} {
+		a, err = NewDiskAcceptor("1", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := a.values["k"]; ok {
+			t.Errorf("compact=%v: purged key was recovered", compact)
+		}
+		if err := a.Accept(ctx, "k", stale, []byte("zombie")); err == nil {
+			t.Errorf("compact=%v: stale accept after purge: want conflict, have none", compact)
+		}
+		if compact {
+			if err := a.compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a.Close()
+	}
+}
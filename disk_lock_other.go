@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package caspaxos
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir opens the lock file in dir. On this platform, it isn't locked, so
+// it's up to the operator to run only one acceptor per directory.
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, diskLockName), os.O_RDWR|os.O_CREATE, 0600)
+}
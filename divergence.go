@@ -0,0 +1,149 @@
+package caspaxos
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigurationHasher models something that can summarize its view of the
+// acceptor configuration. Two proposers with the same configuration return the
+// same hash. LocalProposer implements it; remote proposers can be adapted to
+// it, e.g. from hashes exchanged over gossip.
+type ConfigurationHasher interface {
+	ConfigurationHash() string
+}
+
+// Pauser models something that can refuse writes, while still serving reads.
+// Pauses are tracked per source, so one source resuming writes doesn't undo a
+// pause set by another, e.g. an operator. LocalProposer implements it.
+type Pauser interface {
+	PauseWrites(source string, paused bool)
+}
+
+// DivergenceDetector periodically compares the configuration hashes of a set
+// of proposers. Proposers are expected to disagree briefly during a membership
+// change, but if they disagree for longer than a threshold, it's likely the
+// change was botched, and proposers are silently using different quorums. The
+// detector logs that at the error level, sets the "configuration_divergent"
+// gauge to 1, and can optionally pause writes until the proposers agree again.
+type DivergenceDetector struct {
+	hashers   map[string]ConfigurationHasher
+	threshold time.Duration
+	pausers   []Pauser
+	logger    Logger
+	divergent Gauge
+	now       func() time.Time
+
+	mtx    sync.Mutex
+	since  time.Time // first observed divergence, or zero
+	paused bool
+}
+
+// DivergenceOption sets an optional parameter for a DivergenceDetector.
+type DivergenceOption func(*DivergenceDetector)
+
+// DivergenceLogger sets the logger. By default, nothing is logged.
+func DivergenceLogger(logger Logger) DivergenceOption {
+	return func(d *DivergenceDetector) { d.logger = logger }
+}
+
+// DivergenceMetrics sets the metrics provider. By default, no metrics are
+// recorded.
+func DivergenceMetrics(m Metrics) DivergenceOption {
+	return func(d *DivergenceDetector) { d.divergent = m.Gauge("configuration_divergent") }
+}
+
+// DivergencePause sets pausers which should stop accepting writes while the
+// configuration is divergent. Reads are still served, so the configuration can
+// be repaired. The detector only resumes writes it paused itself, under the
+// "divergence" source. By default, nothing is paused.
+func DivergencePause(pausers ...Pauser) DivergenceOption {
+	return func(d *DivergenceDetector) { d.pausers = pausers }
+}
+
+// NewDivergenceDetector returns a detector over the named hashers, which
+// considers the configuration divergent once they've disagreed for threshold.
+func NewDivergenceDetector(hashers map[string]ConfigurationHasher, threshold time.Duration, options ...DivergenceOption) *DivergenceDetector {
+	d := &DivergenceDetector{
+		hashers:   hashers,
+		threshold: threshold,
+		logger:    NopLogger(),
+		divergent: nopGauge{},
+		now:       time.Now,
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// Run checks the configuration every interval until the context is canceled.
+func (d *DivergenceDetector) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.Check()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Check compares the configuration hashes once, and returns true if they've
+// been divergent for longer than the threshold.
+func (d *DivergenceDetector) Check() bool {
+	hashes := map[string][]string{} // hash: names
+	for name, h := range d.hashers {
+		hash := h.ConfigurationHash()
+		hashes[hash] = append(hashes[hash], name)
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(hashes) <= 1 {
+		if d.paused {
+			d.logger.Log(LevelKey, LevelInfo, "configuration", "converged", "writes", "resumed")
+			d.setPaused(false)
+		}
+		d.since = time.Time{}
+		d.divergent.Set(0)
+		return false
+	}
+
+	now := d.now()
+	if d.since.IsZero() {
+		d.since = now
+	}
+	if now.Sub(d.since) <= d.threshold {
+		return false
+	}
+
+	views := make([]string, 0, len(hashes))
+	for hash, names := range hashes {
+		sort.Strings(names)
+		if len(hash) > 8 {
+			hash = hash[:8]
+		}
+		views = append(views, hash+"="+strings.Join(names, ","))
+	}
+	sort.Strings(views)
+	d.logger.Log(LevelKey, LevelError, "configuration", "divergent", "for", now.Sub(d.since).String(), "views", strings.Join(views, " "))
+	d.divergent.Set(1)
+	if !d.paused && len(d.pausers) > 0 {
+		d.setPaused(true)
+	}
+	return true
+}
+
+func (d *DivergenceDetector) setPaused(paused bool) {
+	for _, p := range d.pausers {
+		p.PauseWrites("divergence", paused)
+	}
+	d.paused = paused
+}
@@ -0,0 +1,76 @@
+package caspaxos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDivergenceDetector(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = NewMemoryAcceptor("4")
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+		m      = newTestMetrics()
+		clock  = &fakeClock{t: time.Now()}
+		ctx    = context.Background()
+	)
+	d := NewDivergenceDetector(
+		map[string]ConfigurationHasher{"p1": p1, "p2": p2},
+		time.Minute,
+		DivergenceLogger(log.With(logger, "component", "divergence")),
+		DivergenceMetrics(m),
+		DivergencePause(p1, p2),
+	)
+	d.now = clock.now
+
+	if d.Check() {
+		t.Fatal("identical configurations: reported divergent")
+	}
+
+	// A botched membership change: only p1 learns about a4.
+	p1.AddAccepter(a4)
+	if d.Check() {
+		t.Fatal("brief divergence: reported divergent")
+	}
+
+	clock.advance(2 * time.Minute)
+	if !d.Check() {
+		t.Fatal("sustained divergence: not reported")
+	}
+	if want, have := 1.0, m.value("configuration_divergent"); want != have {
+		t.Errorf("gauge: want %v, have %v", want, have)
+	}
+	if _, err := p2.Propose(ctx, "k", changeFuncInitializeOnlyOnce("v")); err != ErrPaused {
+		t.Errorf("write while divergent: want %v, have %v", ErrPaused, err)
+	}
+	if _, err := p2.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Errorf("read while divergent: %v", err)
+	}
+
+	// An operator pauses p1 by hand in the meantime.
+	p1.SetPaused(true)
+
+	// Repair the configuration, and writes resume.
+	p2.AddAccepter(a4)
+	if d.Check() {
+		t.Fatal("repaired configuration: reported divergent")
+	}
+	if want, have := 0.0, m.value("configuration_divergent"); want != have {
+		t.Errorf("gauge: want %v, have %v", want, have)
+	}
+	if _, err := p2.Propose(ctx, "k", changeFuncInitializeOnlyOnce("v")); err != nil {
+		t.Errorf("write after repair: %v", err)
+	}
+
+	// The detector doesn't resume the manual pause.
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != ErrPaused {
+		t.Errorf("manually paused proposer: want %v, have %v", ErrPaused, err)
+	}
+}
@@ -0,0 +1,59 @@
+package caspaxos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NextEpoch reads a proposer's epoch from the file at path, increments it,
+// and durably writes it back, returning the incremented epoch. If the file
+// doesn't exist, the previous epoch is taken to be zero. It's meant to be
+// called once whenever a proposer starts, and its result passed to
+// ProposerEpoch, so that every incarnation of a proposer generates ballots
+// greater than any previous incarnation.
+func NextEpoch(path string) (uint64, error) {
+	var epoch uint64
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		epoch, err = strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	case os.IsNotExist(err):
+		// first start
+	default:
+		return 0, err
+	}
+	epoch++
+
+	// Write to a temporary file, sync it, and rename it over the original, so
+	// a crash can't leave a torn or empty epoch file behind.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+	if _, err := f.WriteString(strconv.FormatUint(epoch, 10) + "\n"); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync() // best effort, to persist the rename
+		dir.Close()
+	}
+	return epoch, nil
+}
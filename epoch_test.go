@@ -0,0 +1,57 @@
+package caspaxos
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNextEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-epoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "epoch")
+	for want := uint64(1); want <= 3; want++ {
+		have, err := NextEpoch(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != have {
+			t.Fatalf("want %d, have %d", want, have)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("garbage"), 0600)
+	if _, err := NextEpoch(path); err == nil {
+		t.Fatal("corrupt epoch file: want error, have none")
+	}
+}
+
+func TestEpochRestart(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		m   = newTestMetrics()
+		p1  = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerEpoch(1))
+		ctx = context.Background()
+	)
+	for i := 0; i < 10; i++ {
+		p1.Propose(ctx, "k", changeFuncRead)
+	}
+
+	// A new incarnation with a bumped epoch wins outright, despite its counter
+	// starting from zero.
+	p1 = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerEpoch(2), ProposerMetrics(m))
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0.0, m.value("conflicts"); want != have {
+		t.Errorf("conflicts: want %v, have %v", want, have)
+	}
+}
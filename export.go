@@ -0,0 +1,415 @@
+package caspaxos
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultExportCheckpoint is the key an Exporter stores its checkpoint under,
+// if none is given. It has SystemKeyPrefix, so ProtectSystemKeys covers it.
+const DefaultExportCheckpoint = SystemKeyPrefix + "export"
+
+// ErrCheckpointMoved indicates that the exporter's checkpoint was changed by
+// someone else, e.g. another exporter with the same checkpoint key, while a
+// batch was being published. The batch is exported again on the next attempt.
+var ErrCheckpointMoved = errors.New("export checkpoint was changed concurrently")
+
+// ChangeEvent describes a change to the value of a key. A nil Value means the
+// key was deleted.
+type ChangeEvent struct {
+	// Position is unique and increasing across the events exported under a
+	// checkpoint key. A batch that's published again, because the exporter
+	// failed to record it in the checkpoint, starts from the same position.
+	// But the batch may differ, if the keys were changed again in the
+	// meantime, so consumers which need exact deduplication should also
+	// compare values.
+	Position uint64
+	Key      string
+	Value    []byte
+}
+
+// Sink publishes change events to some downstream system, e.g. a Kafka or NATS
+// topic. Publish should return nil only once every event in the batch is
+// durably published; otherwise, the whole batch is retried.
+type Sink interface {
+	Publish(ctx context.Context, events []ChangeEvent) error
+}
+
+// QuorumReader models a proposer which can read the latest value accepted for
+// a key by a quorum of acceptors, without changing any of their state. Such a
+// read is cheap, but it isn't linearizable: the value may have been accepted
+// by a proposal which is still in flight, or which failed, and a concurrent
+// proposal may already have chosen a newer one.
+type QuorumReader interface {
+	ReadAccepted(ctx context.Context, key string) (value []byte, b Ballot, err error)
+}
+
+// ExportProposer is the proposer an Exporter needs. It reads changed keys with
+// ReadAccepted, and writes the checkpoint with Propose. LocalProposer
+// implements it.
+type ExportProposer interface {
+	Proposer
+	QuorumReader
+}
+
+// KeyLister returns the keys an exporter should export when it starts, before
+// it has been notified of any changes.
+type KeyLister func(ctx context.Context) ([]string, error)
+
+// Exporter is a change-data-capture component. It's notified of every value
+// accepted by the acceptors it's registered with, via their AcceptorOnChosen
+// option, and publishes the keys whose values changed to a sink, in batches.
+// Delivery is at-least-once.
+//
+// Register Chosen with at least a majority of the acceptors. Every chosen
+// value is accepted by a quorum, which includes one of them, so no change is
+// missed, no matter which proposer made it. The notifications only mark keys
+// as changed. The values are read from a quorum of acceptors via the
+// proposer's ReadAccepted, which takes the value with the greatest ballot,
+// and doesn't write to the acceptors. Values equal to the last one exported
+// for the key, e.g. after a read, don't produce events. Only the latest value
+// of a key is exported, so a key that changes several times before it's
+// exported produces a single event.
+//
+// The checkpoint, stored via the proposer, records only the last position, so
+// its size is fixed. It's updated only after a batch is published, so a batch
+// that fails is retried. The keys waiting to be exported, and a digest of the
+// last value exported for each key, are kept in memory, so an exporter that
+// starts can't know what was exported before it. Instead, it exports every
+// key returned by the KeyLister, continuing from the checkpoint's position,
+// which repeats events, but loses none. The exception is a key that's deleted
+// and purged while no exporter is running, which isn't reported. Only one
+// exporter should run per checkpoint key.
+type Exporter struct {
+	sink       Sink
+	proposer   ExportProposer
+	checkpoint string
+	keys       KeyLister
+	batchSize  int
+	interval   time.Duration
+	retry      time.Duration
+	exclude    []string
+	logger     Logger
+	exported   Counter
+	errors     Counter
+	pending    Gauge
+
+	notify chan struct{}
+
+	mtx    sync.Mutex
+	listed bool              // the KeyLister's keys have been marked
+	seq    uint64            // of the last change notification
+	dirty  map[string]uint64 // key: seq of its last change notification
+	last   map[string]string // key: digest of the last value exported
+}
+
+// ExporterOption sets an optional parameter for an Exporter.
+type ExporterOption func(*Exporter)
+
+// ExporterBatchSize sets the maximum number of events per Publish.
+// By default, 100.
+func ExporterBatchSize(n int) ExporterOption {
+	return func(e *Exporter) { e.batchSize = n }
+}
+
+// ExporterInterval sets how long Run waits after it's notified of a change,
+// so that further changes are exported in the same batch. By default, 1
+// second.
+func ExporterInterval(d time.Duration) ExporterOption {
+	return func(e *Exporter) { e.interval = d }
+}
+
+// ExporterRetryInterval sets how long Run waits after a failed export before
+// trying again. By default, 1 second.
+func ExporterRetryInterval(d time.Duration) ExporterOption {
+	return func(e *Exporter) { e.retry = d }
+}
+
+// ExporterExclude ignores keys with any of the given prefixes. The checkpoint
+// key and keys with SystemKeyPrefix are always excluded. By default, nothing
+// else is excluded.
+func ExporterExclude(prefixes ...string) ExporterOption {
+	return func(e *Exporter) { e.exclude = prefixes }
+}
+
+// ExporterLogger sets the logger. By default, nothing is logged.
+func ExporterLogger(logger Logger) ExporterOption {
+	return func(e *Exporter) { e.logger = logger }
+}
+
+// ExporterMetrics sets the metrics provider. By default, no metrics are
+// recorded.
+func ExporterMetrics(m Metrics) ExporterOption {
+	return func(e *Exporter) {
+		e.exported = m.Counter("exported_events")
+		e.errors = m.Counter("export_errors")
+		e.pending = m.Gauge("export_pending")
+	}
+}
+
+// NewExporter returns an Exporter which publishes changes to sink, and stores
+// its checkpoint under the checkpoint key via the proposer. If checkpoint is
+// empty, DefaultExportCheckpoint is used. The keys are exported when the
+// exporter starts.
+func NewExporter(sink Sink, proposer ExportProposer, checkpoint string, keys KeyLister, options ...ExporterOption) *Exporter {
+	if checkpoint == "" {
+		checkpoint = DefaultExportCheckpoint
+	}
+	e := &Exporter{
+		sink:       sink,
+		proposer:   proposer,
+		checkpoint: checkpoint,
+		keys:       keys,
+		batchSize:  100,
+		interval:   time.Second,
+		retry:      time.Second,
+		logger:     NopLogger(),
+		exported:   nopCounter{},
+		errors:     nopCounter{},
+		pending:    nopGauge{},
+		notify:     make(chan struct{}, 1),
+		dirty:      map[string]uint64{},
+		last:       map[string]string{},
+	}
+	for _, option := range options {
+		option(e)
+	}
+	return e
+}
+
+// Chosen is a ChosenFunc, which marks the key as changed. Pass it to
+// AcceptorOnChosen. It doesn't block.
+func (e *Exporter) Chosen(key string, b Ballot, value []byte) {
+	if e.excluded(key) {
+		return
+	}
+	e.mtx.Lock()
+	e.mark(key)
+	e.mtx.Unlock()
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// mark records a change to the key. The caller must hold the mutex.
+func (e *Exporter) mark(key string) {
+	e.seq++
+	e.dirty[key] = e.seq
+}
+
+// Run exports changes as they're notified, until the context is canceled.
+func (e *Exporter) Run(ctx context.Context) error {
+	for {
+		if err := e.Export(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			e.errors.Add(1)
+			e.logger.Log(LevelKey, LevelWarn, "export", "failed", "err", err)
+			select {
+			case <-time.After(e.retry):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-e.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-time.After(e.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Export publishes every change notified since the last export, and, the
+// first time it succeeds, every key returned by the KeyLister. It returns
+// when every change has been published and recorded in the checkpoint, or on
+// the first error.
+func (e *Exporter) Export(ctx context.Context) error {
+	e.mtx.Lock()
+	listed := e.listed
+	e.mtx.Unlock()
+	if !listed {
+		keys, err := e.keys(ctx)
+		if err != nil {
+			return err
+		}
+		e.mtx.Lock()
+		for _, key := range keys {
+			if !e.excluded(key) {
+				e.mark(key)
+			}
+		}
+		e.listed = true
+		e.mtx.Unlock()
+	}
+
+	e.mtx.Lock()
+	pending := make(map[string]uint64, len(e.dirty))
+	for key, seq := range e.dirty {
+		pending[key] = seq
+	}
+	e.mtx.Unlock()
+	e.pending.Set(float64(len(pending)))
+	if len(pending) == 0 {
+		return nil
+	}
+	sorted := make([]string, 0, len(pending))
+	for key := range pending {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	position, err := e.load(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		batch []ChangeEvent
+		read  []string // keys read since the last flush
+	)
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := e.sink.Publish(ctx, batch); err != nil {
+				return err
+			}
+			next := batch[len(batch)-1].Position
+			if err := e.commit(ctx, position, next); err != nil {
+				return err
+			}
+			e.exported.Add(float64(len(batch)))
+			position = next
+		}
+		e.done(batch, read, pending)
+		batch, read = nil, nil
+		return nil
+	}
+	for _, key := range sorted {
+		value, _, err := e.proposer.ReadAccepted(ctx, key)
+		if err != nil {
+			return err
+		}
+		read = append(read, key)
+		e.mtx.Lock()
+		last, ok := e.last[key]
+		e.mtx.Unlock()
+		if (!ok && value == nil) || (ok && last == valueDigest(value)) {
+			continue
+		}
+		batch = append(batch, ChangeEvent{
+			Position: position + uint64(len(batch)) + 1,
+			Key:      key,
+			Value:    value,
+		})
+		if len(batch) >= e.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// done records that the batch was exported, and that the keys which were read
+// need no further export, unless they've changed again since pending was
+// taken.
+func (e *Exporter) done(batch []ChangeEvent, read []string, pending map[string]uint64) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for _, event := range batch {
+		if event.Value == nil {
+			delete(e.last, event.Key)
+		} else {
+			e.last[event.Key] = valueDigest(event.Value)
+		}
+	}
+	for _, key := range read {
+		if e.dirty[key] == pending[key] {
+			delete(e.dirty, key)
+		}
+	}
+	e.pending.Set(float64(len(e.dirty)))
+}
+
+func (e *Exporter) excluded(key string) bool {
+	if key == e.checkpoint || strings.HasPrefix(key, SystemKeyPrefix) {
+		return true
+	}
+	for _, prefix := range e.exclude {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportCheckpoint is the JSON representation of an exporter's checkpoint.
+type exportCheckpoint struct {
+	Position uint64 `json:"position"`
+}
+
+func decodeCheckpoint(buf []byte) (cp exportCheckpoint, err error) {
+	if buf != nil {
+		if err := json.Unmarshal(buf, &cp); err != nil {
+			return cp, fmt.Errorf("invalid export checkpoint: %v", err)
+		}
+	}
+	return cp, nil
+}
+
+// load reads the checkpoint's position from the cluster.
+func (e *Exporter) load(ctx context.Context) (uint64, error) {
+	buf, err := e.proposer.Propose(ctx, e.checkpoint, func(x []byte) []byte { return x })
+	if err != nil {
+		return 0, err
+	}
+	cp, err := decodeCheckpoint(buf)
+	return cp.Position, err
+}
+
+// commit moves the checkpoint from position to next, provided it's still at
+// position.
+func (e *Exporter) commit(ctx context.Context, position, next uint64) error {
+	var commitErr error
+	_, err := e.proposer.Propose(ctx, e.checkpoint, func(current []byte) []byte {
+		var cp exportCheckpoint
+		if cp, commitErr = decodeCheckpoint(current); commitErr != nil {
+			return current
+		}
+		if cp.Position != position {
+			commitErr = ErrCheckpointMoved
+			return current
+		}
+		buf, _ := json.Marshal(exportCheckpoint{Position: next})
+		return buf
+	})
+	if err != nil {
+		return err
+	}
+	return commitErr
+}
+
+// valueDigest summarizes a value, to detect changes. A nil value, i.e. a
+// missing or deleted key, has an empty digest, which differs from the digest
+// of an empty value.
+func valueDigest(value []byte) string {
+	if value == nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte{1}, value...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+package caspaxos
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExporter(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		sink   = &fakeSink{failures: 2}
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1))
+		keys   = func(context.Context) ([]string, error) { return []string{"a", "b", "c", "d"}, nil }
+		ctx    = context.Background()
+	)
+	newExporter := func() *Exporter {
+		return NewExporter(sink, p1, "", keys, ExporterBatchSize(2), ExporterLogger(logger))
+	}
+
+	// The exporter is notified by every acceptor.
+	exporter := newExporter()
+	var acceptors []*MemoryAcceptor
+	for _, addr := range []string{"1", "2", "3"} {
+		a := NewMemoryAcceptor(addr, AcceptorOnChosen(exporter.Chosen))
+		if err := p1.AddAccepter(a); err != nil {
+			t.Fatal(err)
+		}
+		if err := p1.AddPreparer(a); err != nil {
+			t.Fatal(err)
+		}
+		acceptors = append(acceptors, a)
+	}
+	a1, a2, a3 := acceptors[0], acceptors[1], acceptors[2]
+	p2 := NewLocalProposer(2, log.With(logger, "p", 2), a2, a3)
+
+	// Values chosen by any proposer are exported, even if they never reached
+	// some of the acceptors.
+	for key, p := range map[string]*LocalProposer{"a": p1, "b": p2, "c": p2} {
+		if _, err := p.Propose(ctx, key, changeFuncInitializeOnlyOnce(key+"0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// While the sink fails, nothing is recorded, so nothing is lost.
+	for i := 0; i < 2; i++ {
+		if err := exporter.Export(ctx); err == nil {
+			t.Fatalf("export %d: want error, have none", i)
+		}
+	}
+	if err := exporter.Export(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, sink, []ChangeEvent{{1, "a", []byte("a0")}, {2, "b", []byte("b0")}, {3, "c", []byte("c0")}})
+
+	// Reads don't produce events, and reading the changed keys doesn't write
+	// to the acceptors.
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err := p1.Propose(ctx, key, changeFuncRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+	promise := func() Ballot {
+		s := a1.shard("a")
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return s.values["a"].promise
+	}
+	before := promise()
+	if err := exporter.Export(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, sink, nil)
+	if want, have := before, promise(); want != have {
+		t.Errorf("promise after export: want %s, have %s", want, have)
+	}
+
+	// Changes and deletes are exported, including for keys which weren't
+	// listed.
+	if _, err := p2.Propose(ctx, "b", func([]byte) []byte { return []byte("b1") }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p1.Propose(ctx, "c", func([]byte) []byte { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p1.Propose(ctx, "e", changeFuncInitializeOnlyOnce("e0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, sink, []ChangeEvent{{4, "b", []byte("b1")}, {5, "c", nil}, {6, "e", []byte("e0")}})
+
+	// A new exporter continues from the checkpoint's position, and exports
+	// every listed key again.
+	if err := newExporter().Export(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, sink, []ChangeEvent{{7, "a", []byte("a0")}, {8, "b", []byte("b1")}})
+
+	// The checkpoint holds only the position.
+	if buf, err := p1.Propose(ctx, DefaultExportCheckpoint, changeFuncRead); err != nil {
+		t.Fatal(err)
+	} else if want, have := `{"position":8}`, string(buf); want != have {
+		t.Errorf("checkpoint: want %s, have %s", want, have)
+	}
+}
+
+// checkEvents compares the events delivered to the sink since the last call.
+func checkEvents(t *testing.T, sink *fakeSink, want []ChangeEvent) {
+	have := sink.take()
+	if len(want) != len(have) {
+		t.Fatalf("events: want %v, have %v", want, have)
+	}
+	for i := range want {
+		if want[i].Position != have[i].Position || want[i].Key != have[i].Key || (want[i].Value == nil) != (have[i].Value == nil) || string(want[i].Value) != string(have[i].Value) {
+			t.Errorf("event %d: want %v, have %v", i, want[i], have[i])
+		}
+	}
+}
+
+// fakeSink fails the first few publishes, then records events.
+type fakeSink struct {
+	mtx      sync.Mutex
+	failures int
+	events   []ChangeEvent
+}
+
+func (s *fakeSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *fakeSink) take() []ChangeEvent {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
@@ -0,0 +1,29 @@
+package caspaxos
+
+import (
+	"expvar"
+	"sync"
+)
+
+// The core counters are maintained whether or not they're published. They're
+// cheap to update, and it means publishing them late doesn't lose history.
+var (
+	expvarProposes       expvar.Int
+	expvarConflicts      expvar.Int
+	expvarAcceptorErrors expvar.Int
+	expvarPublish        sync.Once
+)
+
+// PublishExpvar publishes the core counters via package expvar, as a map named
+// "caspaxos" with the keys "proposes", "conflicts", and "acceptor_errors".
+// It's meant to be called when e.g. a flag is set, and gives minimal
+// deployments some visibility without adopting a complete metrics stack.
+// Calls after the first are no-ops.
+func PublishExpvar() {
+	expvarPublish.Do(func() {
+		m := expvar.NewMap("caspaxos")
+		m.Set("proposes", &expvarProposes)
+		m.Set("conflicts", &expvarConflicts)
+		m.Set("acceptor_errors", &expvarAcceptorErrors)
+	})
+}
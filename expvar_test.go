@@ -0,0 +1,59 @@
+package caspaxos
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	PublishExpvar()
+	PublishExpvar() // must not panic
+
+	m, ok := expvar.Get("caspaxos").(*expvar.Map)
+	if !ok {
+		t.Fatal("caspaxos map not published")
+	}
+	get := func(key string) int64 {
+		v := m.Get(key)
+		if v == nil {
+			t.Fatalf("%s: not found", key)
+		}
+		i, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		return i
+	}
+
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+		ctx    = context.Background()
+	)
+
+	// Advance p2's ballot, so p1's first proposal must conflict.
+	p2.Propose(ctx, "k", changeFuncRead)
+	p2.Propose(ctx, "k", changeFuncRead)
+
+	var (
+		proposesBefore  = get("proposes")
+		conflictsBefore = get("conflicts")
+	)
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := proposesBefore+1, get("proposes"); want != have {
+		t.Errorf("proposes: want %d, have %d", want, have)
+	}
+	if min, have := conflictsBefore+1, get("conflicts"); have < min {
+		t.Errorf("conflicts: want at least %d, have %d", min, have)
+	}
+}
@@ -0,0 +1,57 @@
+package caspaxos
+
+// KeyEvent is a stage in the lifecycle of a key in an acceptor.
+type KeyEvent string
+
+// Key lifecycle events.
+const (
+	KeyCreated    KeyEvent = "created"    // first value accepted
+	KeyUpdated    KeyEvent = "updated"    // subsequent value accepted
+	KeyTombstoned KeyEvent = "tombstoned" // empty value accepted over a non-empty one
+	KeyPurged     KeyEvent = "purged"     // removed by a Purge
+)
+
+// KeyEventFunc is called by an acceptor when a key changes lifecycle stage.
+type KeyEventFunc func(key string, event KeyEvent)
+
+// AcceptorOnKeyEvent sets a callback for key lifecycle events, which helps
+// operators understand churn in the keyspace. Events are also counted in the
+// "key_events" counter, labeled by "event". Like AcceptorOnChosen, the callback
+// is invoked synchronously while the acceptor holds its lock, and must not
+// block. By default, there is no callback.
+func AcceptorOnKeyEvent(f KeyEventFunc) AcceptorOption {
+	return func(o *acceptorOptions) { o.onKeyEvent = f }
+}
+
+// keyEvents reports key lifecycle events to the callback and metrics.
+type keyEvents struct {
+	observe KeyEventFunc
+	count   Counter
+}
+
+func (o acceptorOptions) keyEvents() keyEvents {
+	return keyEvents{observe: o.onKeyEvent, count: o.metrics.Counter("key_events")}
+}
+
+// accepted records the event for an accept of value, given the key's state
+// before it.
+func (e keyEvents) accepted(key string, before acceptedValue, value []byte) {
+	switch {
+	case before.accepted.isZero():
+		e.record(key, KeyCreated)
+	case value == nil && before.value != nil:
+		e.record(key, KeyTombstoned)
+	default:
+		e.record(key, KeyUpdated)
+	}
+}
+
+// purged records the event for a purge.
+func (e keyEvents) purged(key string) {
+	e.record(key, KeyPurged)
+}
+
+func (e keyEvents) record(key string, event KeyEvent) {
+	e.count.With("event", string(event)).Add(1)
+	e.observe(key, event)
+}
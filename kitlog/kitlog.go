@@ -0,0 +1,41 @@
+// Package kitlog adapts go-kit loggers for use with package caspaxos.
+//
+// A go-kit log.Logger already satisfies caspaxos.Logger, but events will carry
+// caspaxos log levels as plain values, which go-kit's level filters ignore.
+// The adapter translates them to go-kit level values.
+package kitlog
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/peterbourgon/caspaxos"
+)
+
+// New returns a caspaxos.Logger that logs to the go-kit logger.
+func New(logger log.Logger) caspaxos.Logger {
+	return adapter{logger}
+}
+
+type adapter struct{ logger log.Logger }
+
+func (a adapter) Log(keyvals ...interface{}) error {
+	kvs := make([]interface{}, len(keyvals))
+	copy(kvs, keyvals)
+	for i := 0; i < len(kvs)-1; i += 2 {
+		if kvs[i] != caspaxos.LevelKey {
+			continue
+		}
+		switch kvs[i+1] {
+		case caspaxos.LevelDebug:
+			kvs[i], kvs[i+1] = level.Key(), level.DebugValue()
+		case caspaxos.LevelInfo:
+			kvs[i], kvs[i+1] = level.Key(), level.InfoValue()
+		case caspaxos.LevelWarn:
+			kvs[i], kvs[i+1] = level.Key(), level.WarnValue()
+		case caspaxos.LevelError:
+			kvs[i], kvs[i+1] = level.Key(), level.ErrorValue()
+		}
+	}
+	return a.logger.Log(kvs...)
+}
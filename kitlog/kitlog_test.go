@@ -0,0 +1,23 @@
+package kitlog
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/peterbourgon/caspaxos"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(level.NewFilter(log.NewLogfmtLogger(&buf), level.AllowInfo()))
+
+	logger.Log(caspaxos.LevelKey, caspaxos.LevelDebug, "msg", "hidden")
+	logger.Log(caspaxos.LevelKey, caspaxos.LevelInfo, "msg", "shown")
+
+	if want, have := "level=info msg=shown\n", buf.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
@@ -1,12 +1,15 @@
 package caspaxos
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
-
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
+	"sync/atomic"
+	"time"
 )
 
 // Acceptor models a complete, uniquely-addressable acceptor.
@@ -50,49 +53,374 @@ var (
 
 	// ErrNotFound indicates an attempt to remove a non-present acceptor.
 	ErrNotFound = errors.New("not found")
+
+	// ErrJointInProgress indicates an attempt to enter a joint configuration
+	// while already in one.
+	ErrJointInProgress = errors.New("joint configuration already in progress")
+
+	// ErrNoJoint indicates an attempt to leave a joint configuration while not
+	// in one.
+	ErrNoJoint = errors.New("not in a joint configuration")
+
+	// ErrPaused indicates the proposer has been paused with SetPaused, or that
+	// a change was refused because writes have been paused with PauseWrites,
+	// e.g. because its configuration has diverged from other proposers.
+	ErrPaused = errors.New("proposer is paused")
+
+	// ErrNotRetained indicates that a proposal's value was accepted by a
+	// quorum, but the confirmation phase then found a quorum of acceptors
+	// holding neither it nor any later value, e.g. because acceptors lost
+	// their state. Only returned when ProposerConfirm is enabled.
+	ErrNotRetained = errors.New("accepted value is missing from a quorum of acceptors")
+
+	// ErrConfigurationInFlux indicates that the preparers and accepters differ,
+	// e.g. because a GrowCluster or ShrinkCluster is in progress.
+	ErrConfigurationInFlux = errors.New("preparers and accepters differ")
+
+	// ErrBootstrapping indicates that the proposer hasn't yet seen the
+	// minimum number of acceptors set with ProposerMinAcceptors.
+	ErrBootstrapping = errors.New("proposer is bootstrapping: too few acceptors seen")
+
+	// ErrReadFailed indicates that ReadAccepted didn't hear from a quorum of
+	// preparers.
+	ErrReadFailed = errors.New("not enough preparers answered the read")
 )
 
+// AcceptIndeterminateError indicates that the accept phase was confirmed by
+// some, but not a quorum, of the accepters. Unlike ErrAcceptFailed, where no
+// accepter confirmed, the value may still be chosen: a later proposal whose
+// prepare quorum includes one of the confirmed accepters adopts the value, and
+// completes it. So the caller can't assume the change was applied, nor that
+// it wasn't.
+//
+// To resolve the outcome, read the key, e.g. with an identity change function,
+// and retry the change only if the value doesn't reflect it. Blindly retrying a
+// change that isn't idempotent may apply it twice.
+type AcceptIndeterminateError struct {
+	Key       string
+	Ballot    Ballot
+	Value     []byte   // the value which may be chosen
+	Confirmed []string // the accepters which accepted it
+}
+
+func (e AcceptIndeterminateError) Error() string {
+	return fmt.Sprintf(
+		"accept of %q at %s confirmed by %d accepter(s), short of a quorum; the value may or may not be chosen, so read the key to resolve it",
+		e.Key, e.Ballot, len(e.Confirmed),
+	)
+}
+
+// Cause returns ErrAcceptFailed, so callers which only distinguish success
+// from failure can continue to use errors.Cause.
+func (e AcceptIndeterminateError) Cause() error { return ErrAcceptFailed }
+
 // LocalProposer performs the initialization by communicating with acceptors,
 // and keep minimal state needed to generate unique increasing update IDs
 // (ballot numbers).
+//
+// Proposals run concurrently. Each one holds a read lock on the configuration
+// for its duration, so membership changes wait for in-flight proposals, and
+// only briefly takes a separate lock to generate its ballot number.
 type LocalProposer struct {
-	mtx       sync.Mutex
-	ballot    Ballot
-	preparers map[string]Preparer
-	accepters map[string]Accepter
-	logger    log.Logger
+	mtx          sync.RWMutex // guards the configuration
+	ballotMtx    sync.Mutex   // guards ballot and perKey
+	ballot       Ballot
+	perKey       map[string]Ballot // nil unless ProposerPerKeyBallots
+	preparers    map[string]Preparer
+	accepters    map[string]Accepter
+	logger       Logger
+	metrics      Metrics
+	probation    *probation
+	joint        *jointConfiguration
+	paused       int32 // atomic
+	pauseMtx     sync.Mutex
+	writePauses  map[string]bool // sources which have paused writes
+	ballots      BallotStrategy
+	confirm      bool
+	reserve      float64 // fraction of the deadline reserved for accept
+	validators   []prefixValidator
+	limiter      *keyRateLimiter
+	quorumPolicy QuorumPolicy
+	placement    PlacementPolicy
+	hedge        time.Duration // 0 means standby acceptors are only contacted on failure
+	minAcceptors int
+	seen         map[string]bool // preparers ever configured, until there are minAcceptors
+
+	// Instruments, created from metrics.
+	proposes       Counter
+	conflicts      Counter
+	acceptorErrors Counter
+	duration       Histogram
+	acceptorTime   Histogram
+	inFlight       Gauge
+	preparerCount  Gauge
+	accepterCount  Gauge
+}
+
+// ProposerOption sets an optional parameter for a LocalProposer.
+type ProposerOption func(*LocalProposer)
+
+// ProposerMetrics sets the metrics provider used by the proposer.
+// By default, no metrics are recorded.
+func ProposerMetrics(m Metrics) ProposerOption {
+	return func(p *LocalProposer) { p.metrics = m }
+}
+
+// ProposerEpoch sets the epoch of the proposer's ballots. Proposers which may
+// restart with the same ID should use a persistent epoch that's bumped on
+// every restart, e.g. via NextEpoch. By default, the epoch is zero.
+func ProposerEpoch(epoch uint64) ProposerOption {
+	return func(p *LocalProposer) { p.ballot.Epoch = epoch }
+}
+
+// ProposerBallotStrategy sets the strategy used to generate and compare
+// ballots. By default, CounterBallots.
+func ProposerBallotStrategy(s BallotStrategy) ProposerOption {
+	return func(p *LocalProposer) { p.ballots = s }
+}
+
+// ProposerHybridClock makes the proposer generate ballots whose counters are
+// hybrid logical clocks, based on the wall clock. It's shorthand for the
+// HybridClockBallots strategy with time.Now.
+func ProposerHybridClock() ProposerOption {
+	return ProposerBallotStrategy(HybridClockBallots(time.Now))
+}
+
+// ProposerPerKeyBallots makes the proposer track a separate ballot counter for
+// every key, rather than a single counter for all keys. A proposer that's
+// fast-forwarded after a conflict on one key then doesn't carry the greater
+// counter over to unrelated keys, which reduces spurious conflicts when many
+// proposers are active. Ballots are unchanged on the wire, so proposers in
+// either mode can share acceptors. The proposer keeps one ballot in memory for
+// every key it has proposed. By default, a single counter is used.
+func ProposerPerKeyBallots() ProposerOption {
+	return func(p *LocalProposer) { p.perKey = map[string]Ballot{} }
+}
+
+// ProposerConfirm adds a confirmation phase after a successful accept phase.
+// The proposer asks the preparers to prepare its own ballot again, which
+// doesn't disturb other proposals, but reports the currently accepted ballot.
+// A value accepted by a quorum is chosen, and later proposals build on it, so
+// a greater ballot, promised or accepted by a concurrent proposal, doesn't
+// mean the value was lost. Only if a quorum of preparers report an accepted
+// ballot less than the proposer's, i.e. hold neither the value nor a later
+// one, does Propose return the new state along with ErrNotRetained. That can
+// only happen if acceptors lose state, e.g. a MemoryAcceptor that restarted,
+// so it's a check on the deployment, rather than the protocol. Otherwise,
+// including when the confirmation is inconclusive, the result of the accept
+// phase stands. By default, there's no confirmation.
+func ProposerConfirm() ProposerOption {
+	return func(p *LocalProposer) { p.confirm = true }
+}
+
+// ProposerAcceptReserve reserves a fraction of the remaining time before the
+// context deadline, if there is one, for the accept phase. The prepare phase
+// must complete within the rest, so a slow prepare fails fast, rather than
+// consuming the whole budget and guaranteeing an accept timeout. A prepare
+// that runs out of time isn't retried. The fraction must be between 0 and 1.
+// By default, nothing is reserved.
+func ProposerAcceptReserve(fraction float64) ProposerOption {
+	return func(p *LocalProposer) { p.reserve = fraction }
+}
+
+// ProposerQuorumPolicy sets the policy deciding which sets of acceptors
+// constitute a quorum. By default, MajorityQuorum.
+func ProposerQuorumPolicy(q QuorumPolicy) ProposerOption {
+	return func(p *LocalProposer) { p.quorumPolicy = q }
+}
+
+// ProposerPlacementPolicy sets the policy deciding which acceptors are
+// contacted in each phase. By default, BroadcastPlacement.
+func ProposerPlacementPolicy(pp PlacementPolicy) ProposerOption {
+	return func(p *LocalProposer) { p.placement = pp }
+}
+
+// ProposerPlacementHedge sets how long a phase waits for the acceptors chosen
+// by the placement policy to reach quorum, before also contacting the
+// acceptors it passed over. The passed-over acceptors are always contacted as
+// soon as failures make quorum impossible without them. By default, there's no
+// hedge delay, so they're only contacted on failure.
+func ProposerPlacementHedge(d time.Duration) ProposerOption {
+	return func(p *LocalProposer) { p.hedge = d }
+}
+
+// ProposerMinAcceptors prevents a proposer from serving any proposal until at
+// least n distinct acceptors have been configured as preparers, at any time
+// since it was constructed. This guards a freshly started proposer, which can
+// only see some of the acceptors, from reaching a bogus quorum among them;
+// e.g. a quorum of one. Once the minimum has been reached, the proposer serves
+// proposals from then on, even if acceptors are later removed. Until then,
+// proposals fail with ErrBootstrapping. By default, there's no minimum.
+func ProposerMinAcceptors(n int) ProposerOption {
+	return func(p *LocalProposer) { p.minAcceptors = n }
 }
 
 // NewLocalProposer returns a usable Proposer uniquely identified by id.
-// It communicates with the initial set of acceptors.
-func NewLocalProposer(id uint64, logger log.Logger, initial ...Acceptor) *LocalProposer {
+// It communicates with the initial set of acceptors. A nil logger is allowed.
+func NewLocalProposer(id uint64, logger Logger, initial ...Acceptor) *LocalProposer {
+	return NewLocalProposerWithOptions(id, logger, initial)
+}
+
+// NewLocalProposerWithOptions is like NewLocalProposer, but also applies the
+// given options.
+func NewLocalProposerWithOptions(id uint64, logger Logger, initial []Acceptor, options ...ProposerOption) *LocalProposer {
 	p := &LocalProposer{
-		ballot:    Ballot{Counter: 0, ID: id},
-		preparers: map[string]Preparer{},
-		accepters: map[string]Accepter{},
-		logger:    logger,
+		ballot:       Ballot{Counter: 0, ID: id},
+		preparers:    map[string]Preparer{},
+		accepters:    map[string]Accepter{},
+		logger:       logger,
+		metrics:      NopMetrics(),
+		ballots:      CounterBallots(),
+		quorumPolicy: MajorityQuorum(),
+		placement:    BroadcastPlacement(),
+		seen:         map[string]bool{},
+	}
+	for _, option := range options {
+		option(p)
 	}
+	if p.logger == nil {
+		p.logger = NopLogger()
+	}
+	if p.probation != nil {
+		p.probation.logger = p.logger
+	}
+	p.proposes = p.metrics.Counter("proposes")
+	p.conflicts = p.metrics.Counter("conflicts")
+	p.acceptorErrors = p.metrics.Counter("acceptor_errors")
+	p.duration = p.metrics.Histogram("propose_duration_seconds")
+	p.acceptorTime = p.metrics.Histogram("acceptor_duration_seconds")
+	p.inFlight = p.metrics.Gauge("proposals_in_flight")
+	p.preparerCount = p.metrics.Gauge("preparers")
+	p.accepterCount = p.metrics.Gauge("accepters")
 	for _, target := range initial {
 		p.preparers[target.Address()] = target
 		p.accepters[target.Address()] = target
+		p.see(target.Address())
 	}
+	p.preparerCount.Set(float64(len(p.preparers)))
+	p.accepterCount.Set(float64(len(p.accepters)))
 	return p
 }
 
 // Propose a change from a client into the cluster.
+//
+// Requests to acceptors are made with contexts derived from ctx. If ctx is
+// canceled, Propose returns the context error promptly, without waiting for
+// outstanding requests, which are expected to abort when they observe the
+// cancellation. If the accept phase had already begun, the change may or may
+// not have been applied.
 func (p *LocalProposer) Propose(ctx context.Context, key string, f ChangeFunc) (newState []byte, err error) {
-	p.mtx.Lock()
-	defer p.mtx.Unlock()
+	newState, _, err = p.run(ctx, key, f, nil)
+	return newState, err
+}
 
-	newState, err = p.propose(ctx, key, f)
-	if err == ErrPrepareFailed {
-		newState, err = p.propose(ctx, key, f) // allow a single retry, to hide fast-forwards
+// ProposeBallot is like Propose, but also returns the ballot the new state was
+// accepted with. It can be used as a fencing token, or passed to ProposeIf.
+func (p *LocalProposer) ProposeBallot(ctx context.Context, key string, f ChangeFunc) (newState []byte, b Ballot, err error) {
+	return p.run(ctx, key, f, nil)
+}
+
+// ProposeIf implements ConditionedProposer.
+func (p *LocalProposer) ProposeIf(ctx context.Context, key string, expected Ballot, f ChangeFunc) (newState []byte, b Ballot, err error) {
+	return p.run(ctx, key, f, &expected)
+}
+
+// ReadAccepted implements QuorumReader. It asks every preparer for the value
+// it has accepted for key, and once a quorum has answered, returns the one
+// with the greatest ballot. Every preparer must implement AcceptedReader.
+func (p *LocalProposer) ReadAccepted(ctx context.Context, key string) (value []byte, b Ballot, err error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if !p.bootstrapped() {
+		return nil, b, ErrBootstrapping
 	}
 
-	return newState, err
+	type result struct {
+		addr   string
+		value  []byte
+		ballot Ballot
+		err    error
+	}
+
+	addrs := make([]string, 0, len(p.preparers))
+	for addr, target := range p.preparers {
+		if _, ok := target.(AcceptedReader); !ok {
+			return nil, b, ErrAcceptedReadUnsupported
+		}
+		addrs = append(addrs, addr)
+	}
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string, target AcceptedReader) {
+			value, ballot, err := target.Accepted(ctx, key)
+			results <- result{addr, value, ballot, err}
+		}(addr, p.preparers[addr].(AcceptedReader))
+	}
+
+	var (
+		quorum = p.quorum(addrs)
+		failed = map[string]bool{}
+	)
+	for pending := len(addrs); pending > 0 && !quorum.Reached() && quorum.PossibleWithout(failed); pending-- {
+		var result result
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return nil, zeroballot, ctx.Err()
+		}
+		if result.err != nil {
+			p.countAcceptorError(result.err)
+			failed[result.addr] = true
+			continue
+		}
+		quorum.Confirm(result.addr)
+		if p.ballots.Greater(result.ballot, b) {
+			value, b = result.value, result.ballot
+		}
+	}
+	if !quorum.Reached() {
+		return nil, zeroballot, ErrReadFailed
+	}
+	return value, b, nil
+}
+
+func (p *LocalProposer) run(ctx context.Context, key string, f ChangeFunc, expect *Ballot) (newState []byte, b Ballot, err error) {
+	if atomic.LoadInt32(&p.paused) == 1 {
+		return nil, b, ErrPaused
+	}
+
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if !p.bootstrapped() {
+		return nil, b, ErrBootstrapping
+	}
+
+	p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+
+	defer func(begin time.Time) {
+		p.duration.With("success", fmt.Sprint(err == nil)).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	p.proposes.Add(1)
+	expvarProposes.Add(1)
+
+	// The prepare phase may get less time than the whole proposal. Its
+	// deadline is computed once, so a retry doesn't eat into the time
+	// reserved for accept.
+	prepareCtx, cancel := p.prepareContext(ctx)
+	defer cancel()
+
+	newState, b, err = p.propose(ctx, prepareCtx, key, f, expect)
+	if err == ErrPrepareFailed && prepareCtx.Err() == nil {
+		newState, b, err = p.propose(ctx, prepareCtx, key, f, expect) // allow a single retry, to hide fast-forwards
+	}
+
+	return newState, b, err
 }
 
-func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (newState []byte, err error) {
+func (p *LocalProposer) propose(ctx, prepareCtx context.Context, key string, f ChangeFunc, expect *Ballot) (newState []byte, b Ballot, err error) {
 	// From the paper: "A client submits the change function to a proposer. The
 	// proposer generates a ballot number B, by incrementing the current ballot
 	// number's counter."
@@ -101,18 +429,37 @@ func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (
 	// rystsov: "I proved correctness for the case when each *attempt* has a
 	// unique ballot number. [Otherwise] I would bet that linearizability may be
 	// violated."
-	b := p.ballot.inc()
+	b = p.nextBallot(key)
 
 	// Set up a logger, for debugging.
-	logger := level.Debug(log.With(p.logger, "method", "Propose", "B", b))
+	logger := logWith(p.logger, LevelKey, LevelDebug, "method", "Propose", "B", b)
+
+	// Check the key's quota before the prepare phase, so a refused proposal
+	// doesn't disturb other proposers. The change is given back unless it's
+	// sent to the accepters, e.g. if the proposal turns out to be a read.
+	release, ok := p.limiter.reserve(key)
+	if !ok {
+		logger.Log("result", "rate_limited")
+		return nil, b, ErrRateLimited
+	}
+	var changing bool
+	defer func() {
+		if !changing {
+			release()
+		}
+	}()
 
-	// If prepare is successful, we'll have an accepted current state.
-	var currentState []byte
+	// If prepare is successful, we'll have an accepted current state, and the
+	// ballot it was accepted with.
+	var (
+		currentState  []byte
+		currentBallot Ballot
+	)
 
 	// Prepare phase.
 	{
 		// Set up a sub-logger for this phase.
-		logger := log.With(logger, "phase", "prepare")
+		logger := logWith(logger, "phase", "prepare")
 
 		// We collect prepare results into this channel.
 		type result struct {
@@ -121,24 +468,32 @@ func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (
 			ballot Ballot
 			err    error
 		}
-		results := make(chan result, len(p.preparers))
 
 		// Broadcast the prepare requests to the preparers.
 		// (Preparers are just acceptors, serving their first role.)
-		logger.Log("broadcast_to", len(p.preparers))
-		for addr, target := range p.preparers {
+		addrs := make([]string, 0, len(p.preparers))
+		for addr := range p.preparers {
+			addrs = append(addrs, addr)
+		}
+		results := make(chan result, len(addrs))
+		fanout, stop := p.fanout("prepare", addrs, func(addr string) {
 			go func(addr string, target Preparer) {
-				value, ballot, err := target.Prepare(ctx, key, b)
+				begin := time.Now()
+				value, ballot, err := target.Prepare(prepareCtx, key, b)
+				p.observeLatency(addr, "prepare", begin)
+				p.probation.observe(addr, err)
 				results <- result{addr, value, ballot, err}
-			}(addr, target)
-		}
+			}(addr, p.preparers[addr])
+		})
+		defer stop()
+		quorum := fanout.quorum
+		logger.Log("broadcast_to", fanout.pending, "standby", len(fanout.standby), "skipped", len(addrs)-fanout.pending-len(fanout.standby))
 
 		// From the paper: "The proposer waits for F+1 confirmations. If they
 		// all contain the empty value, then the proposer defines the current
 		// state as nil; otherwise, it picks the value of the tuple with the
 		// highest ballot number."
 		var (
-			quorum          = (len(p.preparers) / 2) + 1
 			biggestConfirm  Ballot
 			biggestConflict Ballot
 		)
@@ -146,27 +501,44 @@ func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (
 		// Broadcast the prepare request to the preparers. Observe that once
 		// we've got confirmation from a quorum of preparers, we ignore any
 		// subsequent messages.
-		for i := 0; i < cap(results) && quorum > 0; i++ {
-			result := <-results
+	collect:
+		for fanout.pending > 0 && !quorum.Reached() {
+			var result result
+			select {
+			case result = <-results:
+				fanout.pending--
+			case <-fanout.hedge:
+				logger.Log("hedge", len(fanout.standby))
+				fanout.expand()
+				continue
+			case <-prepareCtx.Done():
+				if err := ctx.Err(); err != nil {
+					logger.Log("result", "canceled", "err", err)
+					return nil, b, err
+				}
+				break collect // out of time reserved for prepare
+			}
 			if result.err != nil {
 				// A conflict indicates that the proposed ballot is too old and
 				// will be rejected; the largest conflicting ballot number
 				// should be used to fast-forward the proposer's ballot number
 				// counter in the case of total (quorum) failure.
 				logger.Log("addr", result.addr, "result", "conflict", "ballot", result.ballot, "err", result.err)
-				if result.ballot.greaterThan(biggestConflict) {
+				p.countAcceptorError(result.err)
+				if p.ballots.Greater(result.ballot, biggestConflict) {
 					biggestConflict = result.ballot
 				}
+				fanout.failed(result.addr)
 			} else {
 				// A confirmation indicates the proposed ballot will succeed,
 				// and the preparer has accepted it as a promise; the largest
 				// confirmed ballot number is used to select which returned
 				// value will be chosen as the current value.
 				logger.Log("addr", result.addr, "result", "confirm", "ballot", result.ballot, "value", prettyPrint(result.value))
-				if result.ballot.greaterThan(biggestConfirm) {
+				if p.ballots.Greater(result.ballot, biggestConfirm) {
 					biggestConfirm, currentState = result.ballot, result.value
 				}
-				quorum--
+				quorum.Confirm(result.addr)
 			}
 		}
 
@@ -176,13 +548,21 @@ func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (
 		// subsequent proposal might succeed. We could try to re-submit the same
 		// request with our updated ballot number, but for now let's leave that
 		// responsibility to the caller.
-		if quorum > 0 {
-			logger.Log("result", "failed", "fast_forward_to", biggestConflict.Counter)
-			p.ballot.Counter = biggestConflict.Counter // fast-forward
-			return nil, ErrPrepareFailed
+		if !quorum.Reached() {
+			logger.Log("result", "failed", "fast_forward_to", biggestConflict)
+			p.fastForward(key, biggestConflict)
+			return nil, b, ErrPrepareFailed
 		}
 
 		logger.Log("result", "success", "current_state", prettyPrint(currentState))
+		currentBallot = biggestConfirm
+	}
+
+	// For a conditioned proposal, stop before changing anything if the value
+	// has been changed since the caller observed it.
+	if expect != nil && *expect != currentBallot {
+		logger.Log("result", "ballot_mismatch", "expected", *expect, "current", currentBallot)
+		return nil, b, BallotMismatchError{Expected: *expect, Current: currentBallot}
 	}
 
 	// We've successfully completed the prepare phase. From the paper: "The
@@ -191,10 +571,22 @@ func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (
 	// as an "accept" message) to the acceptors."
 	newState = f(currentState)
 
+	// Refuse to propose changes while writes are paused, or values which
+	// fail validation.
+	if !unchanged(currentState, newState) && p.writesPaused() {
+		logger.Log("result", "paused")
+		return nil, b, ErrPaused
+	}
+	if err := p.validate(key, newState); err != nil {
+		logger.Log("result", "invalid", "err", err)
+		return nil, b, err
+	}
+	changing = !unchanged(currentState, newState)
+
 	// Accept phase.
 	{
 		// Set up a sub-logger for this phase.
-		logger := log.With(logger, "phase", "accept")
+		logger := logWith(logger, "phase", "accept")
 		logger.Log("current_state", prettyPrint(currentState), "new_state", prettyPrint(newState))
 
 		// We collect accept results into this channel.
@@ -202,43 +594,189 @@ func (p *LocalProposer) propose(ctx context.Context, key string, f ChangeFunc) (
 			addr string
 			err  error
 		}
-		results := make(chan result, len(p.accepters))
 
 		// Broadcast accept messages to the accepters.
-		logger.Log("broadcast_to", len(p.accepters))
-		for addr, target := range p.accepters {
+		addrs := make([]string, 0, len(p.accepters))
+		for addr := range p.accepters {
+			addrs = append(addrs, addr)
+		}
+		results := make(chan result, len(addrs))
+		fanout, stop := p.fanout("accept", addrs, func(addr string) {
 			go func(addr string, target Accepter) {
+				begin := time.Now()
 				err := target.Accept(ctx, key, b, newState)
+				p.observeLatency(addr, "accept", begin)
+				p.probation.observe(addr, err)
 				results <- result{addr, err}
-			}(addr, target)
-		}
+			}(addr, p.accepters[addr])
+		})
+		defer stop()
+		quorum := fanout.quorum
+		logger.Log("broadcast_to", fanout.pending, "standby", len(fanout.standby), "skipped", len(addrs)-fanout.pending-len(fanout.standby))
 
 		// From the paper: "The proposer waits for the F+1 confirmations."
 		// Observe that once we've got confirmation from a quorum of accepters,
 		// we ignore any subsequent messages.
-		quorum := (len(p.accepters) / 2) + 1
-		for i := 0; i < cap(results) && quorum > 0; i++ {
-			result := <-results
+		var confirmed []string
+		for fanout.pending > 0 && !quorum.Reached() {
+			var result result
+			select {
+			case result = <-results:
+				fanout.pending--
+			case <-fanout.hedge:
+				logger.Log("hedge", len(fanout.standby))
+				fanout.expand()
+				continue
+			case <-ctx.Done():
+				logger.Log("result", "canceled", "err", ctx.Err())
+				return nil, b, ctx.Err()
+			}
 			if result.err != nil {
-				logger.Log("addr", result.addr, "result", "conflict", "err", err)
+				logger.Log("addr", result.addr, "result", "conflict", "err", result.err)
+				p.countAcceptorError(result.err)
+				fanout.failed(result.addr)
 			} else {
 				logger.Log("addr", result.addr, "result", "confirm")
-				quorum--
+				quorum.Confirm(result.addr)
+				confirmed = append(confirmed, result.addr)
 			}
 		}
 
-		// If we don't get quorum, I guess we must fail the proposal.
-		if quorum > 0 {
+		// If we don't get quorum, I guess we must fail the proposal. If some
+		// accepters confirmed, the value may yet be chosen, so the caller has
+		// to be told the outcome is unknown, rather than a clean failure.
+		if !quorum.Reached() {
+			if len(confirmed) > 0 {
+				logger.Log("result", "indeterminate", "confirmed", len(confirmed))
+				return nil, b, AcceptIndeterminateError{Key: key, Ballot: b, Value: newState, Confirmed: confirmed}
+			}
 			logger.Log("result", "failed", "err", "not enough confirmations")
-			return nil, ErrAcceptFailed
+			return nil, b, ErrAcceptFailed
 		}
 
 		// Log the success.
 		logger.Log("result", "success", "new_state", prettyPrint(newState))
 	}
 
+	// Confirmation phase, if enabled.
+	if p.confirm {
+		if err := p.confirmPhase(ctx, logWith(logger, "phase", "confirm"), key, b); err != nil {
+			return newState, b, err
+		}
+	}
+
 	// Return the new state to the caller.
-	return newState, nil
+	return newState, b, nil
+}
+
+// prepareContext derives the context for the prepare phase, leaving the
+// reserved fraction of the remaining time for the accept phase.
+func (p *LocalProposer) prepareContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || p.reserve <= 0 || p.reserve >= 1 {
+		return context.WithCancel(ctx)
+	}
+	remaining := time.Until(deadline)
+	return context.WithTimeout(ctx, time.Duration(float64(remaining)*(1-p.reserve)))
+}
+
+// confirmPhase verifies that the value accepted with ballot b for key wasn't
+// lost, by reading it back from the preparers. Preparing the same ballot again
+// is harmless: the acceptor's promise is set to b, which every later proposal
+// exceeds anyway, and its accepted ballot is returned. A preparer that
+// confirms with an accepted ballot less than b doesn't hold the value; one
+// that confirms with b, or reports a conflict with a greater ballot, may. The
+// value is missing only if a quorum of preparers don't hold it.
+func (p *LocalProposer) confirmPhase(ctx context.Context, logger Logger, key string, b Ballot) error {
+	type result struct {
+		addr   string
+		ballot Ballot
+		err    error
+	}
+
+	addrs := make([]string, 0, len(p.preparers))
+	for addr := range p.preparers {
+		addrs = append(addrs, addr)
+	}
+	results := make(chan result, len(addrs))
+	fanout, stop := p.fanout("confirm", addrs, func(addr string) {
+		go func(addr string, target Preparer) {
+			begin := time.Now()
+			_, ballot, err := target.Prepare(ctx, key, b)
+			p.observeLatency(addr, "confirm", begin)
+			p.probation.observe(addr, err)
+			results <- result{addr, ballot, err}
+		}(addr, p.preparers[addr])
+	})
+	defer stop()
+	missing := fanout.quorum // confirmed by preparers which don't hold the value
+	logger.Log("broadcast_to", fanout.pending, "standby", len(fanout.standby), "skipped", len(addrs)-fanout.pending-len(fanout.standby))
+
+	// Stop as soon as the preparers which may hold the value make a quorum
+	// of preparers which don't impossible.
+collect:
+	for fanout.pending > 0 && !missing.Reached() && missing.PossibleWithout(fanout.out) {
+		var result result
+		select {
+		case result = <-results:
+			fanout.pending--
+		case <-fanout.hedge:
+			logger.Log("hedge", len(fanout.standby))
+			fanout.expand()
+			continue
+		case <-ctx.Done():
+			break collect
+		}
+		switch {
+		case result.err == nil && result.ballot != b && !p.ballots.Greater(result.ballot, b):
+			logger.Log("addr", result.addr, "result", "missing", "ballot", result.ballot)
+			missing.Confirm(result.addr)
+		case result.err == nil, p.ballots.Greater(result.ballot, b):
+			logger.Log("addr", result.addr, "result", "retained", "ballot", result.ballot)
+			fanout.failed(result.addr)
+		default:
+			logger.Log("addr", result.addr, "result", "unknown", "err", result.err)
+			fanout.failed(result.addr)
+		}
+	}
+
+	if missing.Reached() {
+		logger.Log("result", "not_retained")
+		return ErrNotRetained
+	}
+	logger.Log("result", "success")
+	return nil
+}
+
+// nextBallot generates the ballot for a new attempt on key.
+func (p *LocalProposer) nextBallot(key string) Ballot {
+	p.ballotMtx.Lock()
+	defer p.ballotMtx.Unlock()
+
+	if p.perKey == nil {
+		p.ballot = p.ballots.Next(p.ballot)
+		return p.ballot
+	}
+
+	current, ok := p.perKey[key]
+	if !ok {
+		current = Ballot{Epoch: p.ballot.Epoch, ID: p.ballot.ID}
+	}
+	current = p.ballots.Next(current)
+	p.perKey[key] = current
+	return current
+}
+
+// fastForward moves the ballot for key past the conflicting ballot.
+func (p *LocalProposer) fastForward(key string, conflict Ballot) {
+	p.ballotMtx.Lock()
+	defer p.ballotMtx.Unlock()
+
+	if p.perKey == nil {
+		p.ballot = p.ballots.FastForward(p.ballot, conflict)
+		return
+	}
+	p.perKey[key] = p.ballots.FastForward(p.perKey[key], conflict)
 }
 
 // AddAccepter adds the target acceptor to the pool of accepters used in the
@@ -251,6 +789,7 @@ func (p *LocalProposer) AddAccepter(target Acceptor) error {
 		return ErrDuplicate
 	}
 	p.accepters[target.Address()] = target
+	p.accepterCount.Set(float64(len(p.accepters)))
 	return nil
 }
 
@@ -264,9 +803,31 @@ func (p *LocalProposer) AddPreparer(target Acceptor) error {
 		return ErrDuplicate
 	}
 	p.preparers[target.Address()] = target
+	p.preparerCount.Set(float64(len(p.preparers)))
+	p.see(target.Address())
 	return nil
 }
 
+// see records that the acceptor at addr has been configured as a preparer.
+// The caller must hold the mutex.
+func (p *LocalProposer) see(addr string) {
+	if len(p.seen) < p.minAcceptors {
+		p.seen[addr] = true
+	}
+}
+
+// Bootstrapped returns true once the proposer has seen the minimum number of
+// acceptors set with ProposerMinAcceptors, and serves proposals.
+func (p *LocalProposer) Bootstrapped() bool {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.bootstrapped()
+}
+
+func (p *LocalProposer) bootstrapped() bool {
+	return len(p.seen) >= p.minAcceptors
+}
+
 // RemovePreparer removes the target acceptor from the pool of preparers used in
 // the first phase of proposals. It's the first step in shrinking the cluster,
 // which is a global process that needs to be orchestrated by an operator.
@@ -277,6 +838,7 @@ func (p *LocalProposer) RemovePreparer(target Acceptor) error {
 		return ErrNotFound
 	}
 	delete(p.preparers, target.Address())
+	p.preparerCount.Set(float64(len(p.preparers)))
 	return nil
 }
 
@@ -290,9 +852,305 @@ func (p *LocalProposer) RemoveAccepter(target Acceptor) error {
 		return ErrNotFound
 	}
 	delete(p.accepters, target.Address())
+	p.accepterCount.Set(float64(len(p.accepters)))
+	return nil
+}
+
+// AddAcceptor grows the proposer's acceptors by target, via GrowCluster with
+// just this proposer. It does nothing if target is already both a preparer and
+// an accepter, and completes a grow that was interrupted, e.g. when target is
+// only an accepter.
+//
+// It's meant for deployments with a single proposer. With several proposers,
+// each step of the protocol has to be taken by every proposer before any of
+// them takes the next step, so use GrowCluster with all of them instead.
+func (p *LocalProposer) AddAcceptor(ctx context.Context, target Acceptor) error {
+	if p.has(target.Address()) == 2 {
+		return nil
+	}
+	return GrowCluster(ctx, target, p)
+}
+
+// RemoveAcceptor shrinks the proposer's acceptors by target, via ShrinkCluster
+// with just this proposer. It does nothing if target is neither a preparer nor
+// an accepter, and completes a shrink that was interrupted, e.g. when target
+// is only an accepter. Like AddAcceptor, it's meant for deployments with a
+// single proposer; otherwise, use ShrinkCluster with all of them.
+func (p *LocalProposer) RemoveAcceptor(ctx context.Context, target Acceptor) error {
+	if p.has(target.Address()) == 0 {
+		return nil
+	}
+	return ShrinkCluster(ctx, target, p)
+}
+
+// has returns the number of roles, as preparer and accepter, that the acceptor
+// at addr has.
+func (p *LocalProposer) has(addr string) int {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	var n int
+	if _, ok := p.preparers[addr]; ok {
+		n++
+	}
+	if _, ok := p.accepters[addr]; ok {
+		n++
+	}
+	return n
+}
+
+// EnterJoint begins a joint configuration change to the next set of acceptors.
+// Until the change is committed or aborted, the proposer sends both prepare
+// and accept messages to the union of the current and next acceptors, and
+// requires a majority of each set to confirm. It's the first step of a
+// ChangeConfiguration.
+func (p *LocalProposer) EnterJoint(next []Acceptor) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.joint != nil {
+		return ErrJointInProgress
+	}
+	if len(p.preparers) != len(p.accepters) {
+		return ErrConfigurationInFlux
+	}
+	for addr := range p.preparers {
+		if _, ok := p.accepters[addr]; !ok {
+			return ErrConfigurationInFlux
+		}
+	}
+
+	j := &jointConfiguration{
+		old:       map[string]bool{},
+		new:       map[string]bool{},
+		preparers: p.preparers,
+		accepters: p.accepters,
+	}
+	preparers, accepters := map[string]Preparer{}, map[string]Accepter{}
+	for addr := range p.preparers {
+		j.old[addr] = true
+		preparers[addr], accepters[addr] = p.preparers[addr], p.accepters[addr]
+	}
+	for _, target := range next {
+		j.new[target.Address()] = true
+		preparers[target.Address()], accepters[target.Address()] = target, target
+		p.see(target.Address())
+	}
+
+	p.joint, p.preparers, p.accepters = j, preparers, accepters
+	p.preparerCount.Set(float64(len(p.preparers)))
+	p.accepterCount.Set(float64(len(p.accepters)))
+	return nil
+}
+
+// CommitJoint completes a joint configuration change, so that only the next
+// set of acceptors is used. It's the final step of a ChangeConfiguration, and
+// may only be taken once every proposer has entered the joint configuration,
+// and every key has been rewritten under it.
+func (p *LocalProposer) CommitJoint() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.joint == nil {
+		return ErrNoJoint
+	}
+	for addr := range p.joint.old {
+		if !p.joint.new[addr] {
+			delete(p.preparers, addr)
+			delete(p.accepters, addr)
+		}
+	}
+
+	p.joint = nil
+	p.preparerCount.Set(float64(len(p.preparers)))
+	p.accepterCount.Set(float64(len(p.accepters)))
 	return nil
 }
 
+// AbortJoint abandons a joint configuration change, restoring the original set
+// of acceptors. Values written under the joint configuration were confirmed by
+// a majority of the original set, so this is always safe, provided no proposer
+// has committed the change.
+func (p *LocalProposer) AbortJoint() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.joint == nil {
+		return ErrNoJoint
+	}
+
+	p.preparers, p.accepters, p.joint = p.joint.preparers, p.joint.accepters, nil
+	p.preparerCount.Set(float64(len(p.preparers)))
+	p.accepterCount.Set(float64(len(p.accepters)))
+	return nil
+}
+
+// ConfigurationHash implements ConfigurationHasher, summarizing the preparers,
+// accepters, and any in-progress joint configuration.
+func (p *LocalProposer) ConfigurationHash() string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	h := sha256.New()
+	write := func(prefix string, addrs []string) {
+		sort.Strings(addrs)
+		fmt.Fprintf(h, "%s:%q\n", prefix, addrs)
+	}
+	var preparers, accepters, next []string
+	for addr := range p.preparers {
+		preparers = append(preparers, addr)
+	}
+	for addr := range p.accepters {
+		accepters = append(accepters, addr)
+	}
+	write("preparers", preparers)
+	write("accepters", accepters)
+	if p.joint != nil {
+		for addr := range p.joint.new {
+			next = append(next, addr)
+		}
+		write("joint", next)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// SetPaused pauses or resumes the proposer. While paused, every proposal,
+// including reads, fails with ErrPaused. It's independent of PauseWrites.
+func (p *LocalProposer) SetPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&p.paused, v)
+}
+
+// PauseWrites implements Pauser. While any source has paused writes, proposals
+// which would change a value fail with ErrPaused. Reads, i.e. proposals whose
+// change function returns the current value, are still served, so the reads
+// which GrowCluster, ShrinkCluster, and ChangeConfiguration depend on succeed.
+func (p *LocalProposer) PauseWrites(source string, paused bool) {
+	p.pauseMtx.Lock()
+	defer p.pauseMtx.Unlock()
+	if !paused {
+		delete(p.writePauses, source)
+		return
+	}
+	if p.writePauses == nil {
+		p.writePauses = map[string]bool{}
+	}
+	p.writePauses[source] = true
+}
+
+func (p *LocalProposer) writesPaused() bool {
+	p.pauseMtx.Lock()
+	defer p.pauseMtx.Unlock()
+	return len(p.writePauses) > 0
+}
+
+// jointConfiguration captures an in-progress joint configuration change.
+type jointConfiguration struct {
+	old, new  map[string]bool
+	preparers map[string]Preparer // original, for abort
+	accepters map[string]Accepter // original, for abort
+}
+
+// fanout starts a phase among the given addrs, which are the acceptors
+// participating in it. Acceptors on probation are skipped, if we can afford
+// to. Of the rest, the ones chosen by the placement policy are sent requests
+// immediately, and the others are held in standby, until they're needed to
+// reach quorum, or the hedge delay elapses. Call stop when the phase is over.
+func (p *LocalProposer) fanout(phase string, addrs []string, send func(addr string)) (f *fanout, stop func()) {
+	quorum := p.quorum(addrs)
+
+	skip := p.probation.exclude(addrs, quorum)
+	candidates := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !skip[addr] {
+			candidates = append(candidates, addr)
+		}
+	}
+
+	// If the placed acceptors can't possibly reach quorum, contact every
+	// candidate instead.
+	f = &fanout{quorum: quorum, send: send, out: map[string]bool{}}
+	for addr := range skip {
+		f.out[addr] = true
+	}
+	placed := map[string]bool{}
+	for _, addr := range p.placement.Place(phase, candidates, quorum) {
+		placed[addr] = true
+	}
+	for _, addr := range candidates {
+		if !placed[addr] {
+			f.standby = append(f.standby, addr)
+			f.out[addr] = true
+		}
+	}
+	if !quorum.PossibleWithout(f.out) {
+		for _, addr := range f.standby {
+			delete(f.out, addr)
+		}
+		f.standby = nil
+	}
+
+	for _, addr := range candidates {
+		if !f.out[addr] {
+			f.pending++
+			send(addr)
+		}
+	}
+
+	stop = func() {}
+	if len(f.standby) > 0 && p.hedge > 0 {
+		t := time.NewTimer(p.hedge)
+		f.hedge, stop = t.C, func() { t.Stop() }
+	}
+	return f, stop
+}
+
+// quorum returns a new quorum for a phase among the given addrs, or, during a
+// joint configuration change, among both configurations. The caller must hold
+// the mutex.
+func (p *LocalProposer) quorum(addrs []string) Quorum {
+	if p.joint != nil {
+		return p.quorumPolicy.Quorum(keys(p.joint.old), keys(p.joint.new))
+	}
+	return p.quorumPolicy.Quorum(addrs)
+}
+
+func keys(m map[string]bool) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	return a
+}
+
+// observeLatency records the duration of a request to the acceptor at addr.
+// By default, every phase is sent to all acceptors and completes with the
+// fastest quorum, so these latencies identify slow acceptors, which don't
+// affect proposals until they're needed to reach quorum.
+func (p *LocalProposer) observeLatency(addr, phase string, begin time.Time) {
+	p.acceptorTime.With("acceptor", addr, "phase", phase).Observe(time.Since(begin).Seconds())
+}
+
+// countAcceptorError classifies an error returned by an acceptor. Conflicts
+// are a normal part of the protocol; anything else is an acceptor error.
+func (p *LocalProposer) countAcceptorError(err error) {
+	if _, ok := err.(ConflictError); ok {
+		p.conflicts.Add(1)
+		expvarConflicts.Add(1)
+		return
+	}
+	p.acceptorErrors.Add(1)
+	expvarAcceptorErrors.Add(1)
+}
+
+// unchanged returns true if a change function returned the current value,
+// i.e. the proposal is a read. A nil value differs from an empty one.
+func unchanged(current, next []byte) bool {
+	return (current == nil) == (next == nil) && bytes.Equal(current, next)
+}
+
 type prettyPrint []byte
 
 func (pp prettyPrint) String() string {
@@ -1,3 +1,439 @@
 package caspaxos
 
-var _ Proposer = (*LocalProposer)(nil)
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	_ Proposer      = (*LocalProposer)(nil)
+	_ JointProposer = (*LocalProposer)(nil)
+)
+
+func TestCustomBallotStrategy(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerBallotStrategy(steppedBallots{10}))
+		ctx = context.Background()
+	)
+	for i := 0; i < 3; i++ {
+		if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := (Ballot{Counter: 30, ID: 1}), p1.ballot; want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+type steppedBallots struct{ step uint64 }
+
+func (s steppedBallots) Next(current Ballot) Ballot {
+	current.Counter += s.step
+	return current
+}
+
+func (steppedBallots) FastForward(current, conflict Ballot) Ballot {
+	current.Counter = conflict.Counter
+	return current
+}
+
+func (steppedBallots) Greater(a, b Ballot) bool { return a.greaterThan(b) }
+
+func TestConcurrentDistinctKeys(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		a1      = &gatedAcceptor{NewMemoryAcceptor("1"), "slow", release}
+		a2      = &gatedAcceptor{NewMemoryAcceptor("2"), "slow", release}
+		a3      = &gatedAcceptor{NewMemoryAcceptor("3"), "slow", release}
+		p1      = NewLocalProposer(1, nil, a1, a2, a3)
+		ctx     = context.Background()
+		slow    = make(chan error, 1)
+	)
+	go func() {
+		_, err := p1.Propose(ctx, "slow", changeFuncInitializeOnlyOnce("x"))
+		slow <- err
+	}()
+
+	// A proposal for another key shouldn't wait for the slow one.
+	fast := make(chan error, 1)
+	go func() {
+		_, err := p1.Propose(ctx, "fast", changeFuncInitializeOnlyOnce("y"))
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proposal for a distinct key was blocked")
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkProposeDistinctKeys(b *testing.B) {
+	var (
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		p1     = NewLocalProposer(1, nil, a1, a2, a3)
+		ctx    = context.Background()
+		worker int64
+	)
+	b.RunParallel(func(pb *testing.PB) {
+		key := fmt.Sprintf("key-%d", atomic.AddInt64(&worker, 1))
+		for pb.Next() {
+			if _, err := p1.Propose(ctx, key, changeFuncRead); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// gatedAcceptor blocks prepares for one key until the gate is closed.
+type gatedAcceptor struct {
+	*MemoryAcceptor
+	key  string
+	gate chan struct{}
+}
+
+func (a *gatedAcceptor) Prepare(ctx context.Context, key string, b Ballot) ([]byte, Ballot, error) {
+	if key == a.key {
+		<-a.gate
+	}
+	return a.MemoryAcceptor.Prepare(ctx, key, b)
+}
+
+func TestPerKeyBallots(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerPerKeyBallots())
+		p2  = NewLocalProposer(2, nil, a1, a2, a3)
+		ctx = context.Background()
+	)
+
+	// Make p2 push key "a" far ahead, so p1 is fast-forwarded on it.
+	for i := 0; i < 100; i++ {
+		p2.Propose(ctx, "a", changeFuncRead)
+	}
+	if _, err := p1.Propose(ctx, "a", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	if have := p1.perKey["a"].Counter; have <= 100 {
+		t.Errorf("key a: want counter above 100, have %d", have)
+	}
+
+	// An unrelated key starts from scratch.
+	if _, err := p1.Propose(ctx, "b", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := (Ballot{Counter: 1, ID: 1}), p1.perKey["b"]; want != have {
+		t.Errorf("key b: want %s, have %s", want, have)
+	}
+}
+
+func TestConfirmPhase(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		contended int32
+		acceptors []Acceptor
+		amnesiacs []*amnesiacAcceptor
+	)
+	for _, addr := range []string{"1", "2", "3"} {
+		a := &interceptAcceptor{MemoryAcceptor: NewMemoryAcceptor(addr)}
+		a.afterAccept = func(key string) {
+			// Simulate a concurrent proposer, which prepares a greater ballot
+			// right after the acceptor accepts p1's value.
+			if atomic.LoadInt32(&contended) == 1 {
+				a.MemoryAcceptor.Prepare(ctx, key, Ballot{Counter: 1000, ID: 2})
+			}
+		}
+		amnesiac := &amnesiacAcceptor{Acceptor: a}
+		acceptors, amnesiacs = append(acceptors, amnesiac), append(amnesiacs, amnesiac)
+	}
+	p1 := NewLocalProposerWithOptions(1, nil, acceptors, ProposerConfirm())
+
+	if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+		t.Fatalf("uncontended: %v", err)
+	}
+
+	// Acceptors which forget what they accepted lose the value.
+	for _, a := range amnesiacs {
+		atomic.StoreInt32(&a.forget, 1)
+	}
+	value, err := p1.Propose(ctx, "k", func([]byte) []byte { return []byte("y") })
+	if want, have := ErrNotRetained, err; want != have {
+		t.Fatalf("forgotten: want %v, have %v", want, have)
+	}
+	if want, have := "y", string(value); want != have {
+		t.Errorf("forgotten: want %q, have %q", want, have)
+	}
+	for _, a := range amnesiacs {
+		atomic.StoreInt32(&a.forget, 0)
+	}
+
+	// But a greater ballot doesn't mean the value was lost.
+	atomic.StoreInt32(&contended, 1)
+	if _, err := p1.Propose(ctx, "k", func([]byte) []byte { return []byte("z") }); err != nil {
+		t.Fatalf("contended: %v", err)
+	}
+}
+
+// amnesiacAcceptor, once forget is set, answers every prepare as if it had
+// never accepted anything, like an acceptor that lost its state.
+type amnesiacAcceptor struct {
+	Acceptor
+	forget int32 // atomic
+}
+
+func (a *amnesiacAcceptor) Prepare(ctx context.Context, key string, b Ballot) ([]byte, Ballot, error) {
+	if atomic.LoadInt32(&a.forget) == 1 {
+		return nil, Ballot{}, nil
+	}
+	return a.Acceptor.Prepare(ctx, key, b)
+}
+
+// interceptAcceptor calls afterAccept after every successful accept.
+type interceptAcceptor struct {
+	*MemoryAcceptor
+	afterAccept func(key string)
+}
+
+func (a *interceptAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	err := a.MemoryAcceptor.Accept(ctx, key, b, value)
+	if err == nil {
+		a.afterAccept(key)
+	}
+	return err
+}
+
+func TestAcceptReserve(t *testing.T) {
+	var (
+		a1          = &deadlineAcceptor{MemoryAcceptor: NewMemoryAcceptor("1")}
+		p1          = NewLocalProposerWithOptions(1, nil, []Acceptor{a1}, ProposerAcceptReserve(0.5))
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	)
+	defer cancel()
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+
+	a1.mtx.Lock()
+	defer a1.mtx.Unlock()
+	deadline, _ := ctx.Deadline()
+	if want, have := deadline, a1.accept; !want.Equal(have) {
+		t.Errorf("accept deadline: want %s, have %s", want, have)
+	}
+	if limit, have := deadline.Add(-20*time.Second), a1.prepare; have.After(limit) {
+		t.Errorf("prepare deadline: want at most %s, have %s", limit, have)
+	}
+}
+
+func TestAcceptReserveTimeout(t *testing.T) {
+	var (
+		a1          = &blockingAcceptor{MemoryAcceptor: NewMemoryAcceptor("1")}
+		p1          = NewLocalProposerWithOptions(1, nil, []Acceptor{a1}, ProposerAcceptReserve(0.5))
+		ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	)
+	defer cancel()
+
+	// When the prepare phase runs out of time, it isn't retried, since a
+	// retry could only use the time reserved for accept.
+	if _, err := p1.Propose(ctx, "k", changeFuncRead); err != ErrPrepareFailed {
+		t.Fatalf("want %v, have %v", ErrPrepareFailed, err)
+	}
+	if want, have := int32(1), atomic.LoadInt32(&a1.prepares); want != have {
+		t.Errorf("prepares: want %d, have %d", want, have)
+	}
+}
+
+// deadlineAcceptor records the deadlines of the contexts it's passed.
+type deadlineAcceptor struct {
+	*MemoryAcceptor
+	mtx     sync.Mutex
+	prepare time.Time
+	accept  time.Time
+}
+
+func (a *deadlineAcceptor) Prepare(ctx context.Context, key string, b Ballot) ([]byte, Ballot, error) {
+	a.mtx.Lock()
+	a.prepare, _ = ctx.Deadline()
+	a.mtx.Unlock()
+	return a.MemoryAcceptor.Prepare(ctx, key, b)
+}
+
+func (a *deadlineAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	a.mtx.Lock()
+	a.accept, _ = ctx.Deadline()
+	a.mtx.Unlock()
+	return a.MemoryAcceptor.Accept(ctx, key, b, value)
+}
+
+func TestProposeCancellation(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		m       = newTestMetrics()
+		a1      = &blockingAcceptor{MemoryAcceptor: NewMemoryAcceptor("1")}
+		a2      = &blockingAcceptor{MemoryAcceptor: NewMemoryAcceptor("2")}
+		a3      = &blockingAcceptor{MemoryAcceptor: NewMemoryAcceptor("3"), release: release} // ignores ctx
+		p1      = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerMetrics(m))
+		before  = runtime.NumGoroutine()
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p1.Propose(ctx, "k", changeFuncRead)
+		errs <- err
+	}()
+	for m.value("proposals_in_flight") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Propose returns promptly, even though a3 ignores the cancellation.
+	cancel()
+	select {
+	case err := <-errs:
+		if want, have := context.Canceled, err; want != have {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Propose didn't return after cancellation")
+	}
+	if want, have := 0.0, m.value("proposals_in_flight"); want != have {
+		t.Errorf("proposals_in_flight: want %v, have %v", want, have)
+	}
+
+	// Once a3 returns, every goroutine is freed.
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if want, have := before, runtime.NumGoroutine(); have > want {
+		t.Errorf("goroutines: want at most %d, have %d", want, have)
+	}
+}
+
+// blockingAcceptor blocks every prepare until the context is done or, if
+// release is set, until release is closed.
+type blockingAcceptor struct {
+	*MemoryAcceptor
+	release  chan struct{}
+	prepares int32 // atomic
+}
+
+func (a *blockingAcceptor) Prepare(ctx context.Context, key string, b Ballot) ([]byte, Ballot, error) {
+	atomic.AddInt32(&a.prepares, 1)
+	if a.release != nil {
+		<-a.release
+		return nil, Ballot{}, errors.New("released")
+	}
+	<-ctx.Done()
+	return nil, Ballot{}, ctx.Err()
+}
+
+func TestAcceptIndeterminate(t *testing.T) {
+	var (
+		ctx = context.Background()
+		a1  = NewMemoryAcceptor("1")
+		a2  = &rejectAcceptor{NewMemoryAcceptor("2")}
+		a3  = &rejectAcceptor{NewMemoryAcceptor("3")}
+	)
+
+	// One of three accepters confirms: the value may or may not be chosen.
+	p1 := NewLocalProposer(1, nil, a1, a2, a3)
+	_, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x"))
+	aie, ok := err.(AcceptIndeterminateError)
+	if !ok {
+		t.Fatalf("want AcceptIndeterminateError, have %v", err)
+	}
+	if want, have := "[1]", fmt.Sprint(aie.Confirmed); want != have {
+		t.Errorf("confirmed: want %s, have %s", want, have)
+	}
+	if want, have := "x", string(aie.Value); want != have {
+		t.Errorf("value: want %q, have %q", want, have)
+	}
+	if want, have := ErrAcceptFailed, errors.Cause(err); want != have {
+		t.Errorf("cause: want %v, have %v", want, have)
+	}
+
+	// No accepter confirms: a clean failure.
+	p2 := NewLocalProposer(2, nil, a2, a3)
+	if _, err := p2.Propose(ctx, "k", changeFuncInitializeOnlyOnce("y")); err != ErrAcceptFailed {
+		t.Errorf("want ErrAcceptFailed, have %v", err)
+	}
+}
+
+func TestReadAccepted(t *testing.T) {
+	var (
+		ctx = context.Background()
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = &unreadableAcceptor{NewMemoryAcceptor("3")}
+		p1  = NewLocalProposer(1, nil, a1, a2, a3)
+	)
+	if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value with the greatest ballot in the quorum wins, even if only one
+	// acceptor holds it. The third acceptor can't be read, so the quorum must
+	// include the first.
+	b := Ballot{Counter: 100, ID: 2}
+	if err := a1.Accept(ctx, "k", b, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	value, have, err := p1.ReadAccepted(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "y"; want != string(value) || b != have {
+		t.Errorf("want %q with ballot %s, have %q with ballot %s", want, b, value, have)
+	}
+
+	// Without a quorum, the read fails.
+	p2 := NewLocalProposer(2, nil, a1, a3)
+	if _, _, err := p2.ReadAccepted(ctx, "k"); err != ErrReadFailed {
+		t.Errorf("want %v, have %v", ErrReadFailed, err)
+	}
+
+	// Every preparer must support the read.
+	type plainAcceptor struct{ Acceptor }
+	p3 := NewLocalProposer(3, nil, a1, plainAcceptor{a2})
+	if _, _, err := p3.ReadAccepted(ctx, "k"); err != ErrAcceptedReadUnsupported {
+		t.Errorf("want %v, have %v", ErrAcceptedReadUnsupported, err)
+	}
+}
+
+// unreadableAcceptor fails every AcceptedReader read.
+type unreadableAcceptor struct{ *MemoryAcceptor }
+
+func (a *unreadableAcceptor) Accepted(ctx context.Context, key string) ([]byte, Ballot, error) {
+	return nil, zeroballot, errRejected
+}
+
+var errRejected = errors.New("rejected")
+
+// rejectAcceptor confirms every prepare, but fails every accept.
+type rejectAcceptor struct{ *MemoryAcceptor }
+
+func (a *rejectAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	return errRejected
+}
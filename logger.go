@@ -0,0 +1,55 @@
+package caspaxos
+
+// Logger is the logging interface used throughout the package. It's the same
+// shape as go-kit's log.Logger, so go-kit loggers can be used directly; see
+// package kitlog for an adapter that also preserves log levels, and
+// NewSlogLogger for the standard library.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// LevelKey is the key under which the package logs the Level of an event.
+const LevelKey = "level"
+
+// Level is the severity of a log event.
+type Level string
+
+// Levels used by the package.
+const (
+	LevelDebug Level = "debug"
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+func (l Level) String() string { return string(l) }
+
+// NopLogger returns a Logger that does nothing.
+func NopLogger() Logger { return nopLogger{} }
+
+type nopLogger struct{}
+
+func (nopLogger) Log(...interface{}) error { return nil }
+
+// logWith returns a Logger that prepends keyvals to every event.
+func logWith(logger Logger, keyvals ...interface{}) Logger {
+	if l, ok := logger.(*contextLogger); ok {
+		return &contextLogger{
+			logger:  l.logger,
+			keyvals: append(append([]interface{}{}, l.keyvals...), keyvals...),
+		}
+	}
+	return &contextLogger{logger: logger, keyvals: keyvals}
+}
+
+type contextLogger struct {
+	logger  Logger
+	keyvals []interface{}
+}
+
+func (l *contextLogger) Log(keyvals ...interface{}) error {
+	kvs := make([]interface{}, 0, len(l.keyvals)+len(keyvals))
+	kvs = append(kvs, l.keyvals...)
+	kvs = append(kvs, keyvals...)
+	return l.logger.Log(kvs...)
+}
@@ -0,0 +1,64 @@
+//go:build go1.21
+// +build go1.21
+
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// NewSlogLogger adapts a log/slog logger to a Logger. Events are logged at the
+// slog level corresponding to their LevelKey value, or at info if they don't
+// have one. All other keyvals become attributes.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger}
+}
+
+type slogLogger struct{ logger *slog.Logger }
+
+func (l slogLogger) Log(keyvals ...interface{}) error {
+	lvl := slog.LevelInfo
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] == LevelKey {
+			lvl = slogLevel(keyvals[i+1])
+		}
+	}
+
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, lvl) {
+		return nil
+	}
+
+	attrs := make([]interface{}, 0, len(keyvals)/2+1)
+	for i := 0; i < len(keyvals); i += 2 {
+		if keyvals[i] == LevelKey {
+			continue
+		}
+		var v interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		if s, ok := v.(fmt.Stringer); ok {
+			v = s.String() // as go-kit does, so e.g. []byte types print sensibly
+		}
+		attrs = append(attrs, slog.Any(fmt.Sprint(keyvals[i]), v))
+	}
+
+	l.logger.Log(ctx, lvl, "", attrs...)
+	return nil
+}
+
+func slogLevel(v interface{}) slog.Level {
+	switch v {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,32 @@
+//go:build go1.21
+// +build go1.21
+
+package caspaxos
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		opts   = &slog.HandlerOptions{ReplaceAttr: dropTime}
+		logger = NewSlogLogger(slog.New(slog.NewTextHandler(&buf, opts)))
+	)
+
+	logger.Log(LevelKey, LevelDebug, "k", "hidden")
+	logWith(logger, LevelKey, LevelWarn).Log("B", Ballot{Counter: 1, ID: 2}, "v", prettyPrint(nil))
+
+	if want, have := "level=WARN msg=\"\" B=Counter:1/ID:2 v=Ø\n", buf.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		return slog.Attr{}
+	}
+	return a
+}
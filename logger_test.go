@@ -0,0 +1,25 @@
+package caspaxos
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLogWith(t *testing.T) {
+	var (
+		rec    recordingLogger
+		logger = logWith(logWith(&rec, "a", 1), "b", 2)
+	)
+	logger.Log("c", 3)
+	logger.Log("d", 4)
+	if want, have := "[[a 1 b 2 c 3] [a 1 b 2 d 4]]", fmt.Sprint(rec.events); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+type recordingLogger struct{ events [][]interface{} }
+
+func (l *recordingLogger) Log(keyvals ...interface{}) error {
+	l.events = append(l.events, keyvals)
+	return nil
+}
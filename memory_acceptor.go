@@ -4,13 +4,65 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
-// MemoryAcceptor persists data in-memory.
+// MemoryAcceptor persists data in-memory. Keys are spread over a fixed number
+// of independently locked shards, so operations on unrelated keys don't
+// serialize behind each other.
 type MemoryAcceptor struct {
-	mtx    sync.Mutex
 	addr   string
-	values map[string]acceptedValue
+	shards [memoryShards]memoryShard
+	count  int64 // total keys, for the gauge
+	chosen ChosenFunc
+	events keyEvents
+
+	prepares Counter
+	accepts  Counter
+	keys     Gauge
+}
+
+// AcceptorOption sets an optional parameter for an acceptor.
+type AcceptorOption func(*acceptorOptions)
+
+type acceptorOptions struct {
+	metrics    Metrics
+	onChosen   ChosenFunc
+	onKeyEvent KeyEventFunc
+}
+
+// AcceptorMetrics sets the metrics provider used by the acceptor.
+// By default, no metrics are recorded.
+func AcceptorMetrics(m Metrics) AcceptorOption {
+	return func(o *acceptorOptions) { o.metrics = m }
+}
+
+// ChosenFunc is called by an acceptor whenever it records an accepted value.
+// The value must not be modified.
+type ChosenFunc func(key string, b Ballot, value []byte)
+
+// AcceptorOnChosen sets a callback which fires every time the acceptor records
+// an accept, so learners and watchers can follow changes without polling the
+// whole keyspace. Note that a value accepted by a single acceptor isn't
+// necessarily chosen by a quorum; consumers that need certainty should watch a
+// majority of acceptors, and take the value with the greatest ballot. The
+// callback is invoked synchronously, in ballot order for each key, while the
+// acceptor holds its lock; it must not block, or call back into the acceptor.
+// By default, there is no callback.
+func AcceptorOnChosen(f ChosenFunc) AcceptorOption {
+	return func(o *acceptorOptions) { o.onChosen = f }
+}
+
+func makeAcceptorOptions(options []AcceptorOption) acceptorOptions {
+	o := acceptorOptions{
+		metrics:    NopMetrics(),
+		onChosen:   func(string, Ballot, []byte) {},
+		onKeyEvent: func(string, KeyEvent) {},
+	}
+	for _, option := range options {
+		option(&o)
+	}
+	return o
 }
 
 // An accepted value is associated with a key in an acceptor.
@@ -21,16 +73,52 @@ type acceptedValue struct {
 	value    []byte
 }
 
+const memoryShards = 64
+
+type memoryShard struct {
+	mtx       sync.Mutex
+	values    map[string]acceptedValue
+	watermark Ballot // greatest tombstone purged from the shard
+}
+
+// shard returns the shard responsible for key. The hash is an inline FNV-1a,
+// which avoids allocating on every request.
+func (a *MemoryAcceptor) shard(key string) *memoryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &a.shards[h%memoryShards]
+}
+
+// store saves av for key in the locked shard, and maintains the key count.
+func (a *MemoryAcceptor) store(s *memoryShard, key string, av acceptedValue) {
+	if _, ok := s.values[key]; !ok {
+		a.keys.Set(float64(atomic.AddInt64(&a.count, 1)))
+	}
+	s.values[key] = av
+}
+
 // The zero ballot can be used to clear promises.
 var zeroballot Ballot
 
 // NewMemoryAcceptor returns a usable in-memory acceptor.
 // Useful primarily for testing.
-func NewMemoryAcceptor(addr string) *MemoryAcceptor {
-	return &MemoryAcceptor{
-		addr:   addr,
-		values: map[string]acceptedValue{},
+func NewMemoryAcceptor(addr string, options ...AcceptorOption) *MemoryAcceptor {
+	o := makeAcceptorOptions(options)
+	a := &MemoryAcceptor{
+		addr:     addr,
+		chosen:   o.onChosen,
+		events:   o.keyEvents(),
+		prepares: o.metrics.Counter("prepares"),
+		accepts:  o.metrics.Counter("accepts"),
+		keys:     o.metrics.Gauge("keys"),
+	}
+	for i := range a.shards {
+		a.shards[i].values = map[string]acceptedValue{}
 	}
+	return a
 }
 
 // Address implements Addresser.
@@ -40,13 +128,111 @@ func (a *MemoryAcceptor) Address() string {
 
 // Prepare implements the first-phase responsibilities of an acceptor.
 func (a *MemoryAcceptor) Prepare(ctx context.Context, key string, b Ballot) (value []byte, current Ballot, err error) {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, zeroballot, err
+	}
+
+	s := a.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
 	// Select the promise/accepted/value tuple for this key.
-	// A zero value is useful.
-	av := a.values[key]
+	// A zero value is useful, unless the key may have been purged.
+	av, ok := s.values[key]
+	if !ok {
+		if err := belowWatermark(s.watermark, b); err != nil {
+			a.prepares.With("result", "conflict").Add(1)
+			return nil, s.watermark, err
+		}
+	}
+
+	if current, err = av.prepare(b); err != nil {
+		a.prepares.With("result", "conflict").Add(1)
+		return av.value, current, err
+	}
+
+	a.store(s, key, av)
+	a.prepares.With("result", "confirm").Add(1)
+	return av.value, current, nil
+}
 
+// Accept implements the second-phase responsibilities of an acceptor.
+func (a *MemoryAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s := a.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Select the promise/accepted/value tuple for this key.
+	// A zero value is useful, unless the key may have been purged.
+	av, ok := s.values[key]
+	if !ok {
+		if err := belowWatermark(s.watermark, b); err != nil {
+			a.accepts.With("result", "conflict").Add(1)
+			return err
+		}
+	}
+	prev := av
+
+	if err := av.accept(b, value); err != nil {
+		a.accepts.With("result", "conflict").Add(1)
+		return err
+	}
+
+	a.store(s, key, av)
+	a.accepts.With("result", "confirm").Add(1)
+	a.events.accepted(key, prev, value)
+	a.chosen(key, b, value)
+	return nil
+}
+
+// Purge implements Purger.
+func (a *MemoryAcceptor) Purge(ctx context.Context, key string, tombstone Ballot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s := a.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	av, ok := s.values[key]
+	if !ok {
+		return nil
+	}
+	if err := av.purge(tombstone); err != nil {
+		return err
+	}
+
+	delete(s.values, key)
+	a.keys.Set(float64(atomic.AddInt64(&a.count, -1)))
+	if tombstone.greaterThan(s.watermark) {
+		s.watermark = tombstone
+	}
+	a.events.purged(key)
+	return nil
+}
+
+// Accepted implements AcceptedReader.
+func (a *MemoryAcceptor) Accepted(ctx context.Context, key string) (value []byte, accepted Ballot, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, zeroballot, err
+	}
+
+	s := a.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	av := s.values[key]
+	return av.value, av.accepted, nil
+}
+
+// prepare implements the first-phase logic of an acceptor for a single key.
+// If it returns a nil error, av has been updated, and must be persisted.
+func (av *acceptedValue) prepare(b Ballot) (current Ballot, err error) {
 	// rystsov: "If a promise isn't empty during the prepare phase, we should
 	// compare the proposed ballot number against the promise, and update the
 	// promise if the promise is less."
@@ -54,18 +240,17 @@ func (a *MemoryAcceptor) Prepare(ctx context.Context, key string, b Ballot) (val
 	// Here, we exploit the fact that a zero-value ballot number is less than
 	// any non-zero-value ballot number.
 	if av.promise.greaterThan(b) {
-		return av.value, av.promise, ConflictError{Proposed: b, Existing: av.promise}
+		return av.promise, ConflictError{Proposed: b, Existing: av.promise}
 	}
 
 	// Similarly, return a conflict if we already saw a greater ballot number.
 	if av.accepted.greaterThan(b) {
-		return av.value, av.accepted, ConflictError{Proposed: b, Existing: av.accepted}
+		return av.accepted, ConflictError{Proposed: b, Existing: av.accepted}
 	}
 
 	// If everything is satisfied, from the paper: "persist the ballot number as
 	// a promise."
 	av.promise = b
-	a.values[key] = av
 
 	// From the paper: "and return a confirmation either with an empty value (if
 	// it hasn't accepted any value yet) or with a tuple of an accepted value
@@ -75,18 +260,12 @@ func (a *MemoryAcceptor) Prepare(ctx context.Context, key string, b Ballot) (val
 	// which we take to mean "an empty value". The receiver should interpret
 	// value == nil as an empty value and ignore the returned ballot, which will
 	// be zero.
-	return av.value, av.accepted, nil
+	return av.accepted, nil
 }
 
-// Accept implements the second-phase responsibilities of an acceptor.
-func (a *MemoryAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
-
-	// Select the promise/accepted/value tuple for this key.
-	// A zero value is useful.
-	av := a.values[key]
-
+// accept implements the second-phase logic of an acceptor for a single key.
+// If it returns a nil error, av has been updated, and must be persisted.
+func (av *acceptedValue) accept(b Ballot, value []byte) error {
 	// Return a conflict if it already saw a greater ballot number, either in
 	// the promise or in the actual ballot number.
 	//
@@ -106,16 +285,16 @@ func (a *MemoryAcceptor) Accept(ctx context.Context, key string, b Ballot, value
 	// If everything is satisfied, from the paper: "Erase the promise, mark the
 	// received tuple as the accepted value."
 	av.promise, av.accepted, av.value = zeroballot, b, value
-	a.values[key] = av
 
 	// From the paper: "Return a confirmation."
 	return nil
 }
 
 func (a *MemoryAcceptor) dumpValue(key string) []byte {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
-	av := a.values[key]
+	s := a.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	av := s.values[key]
 	dst := make([]byte, len(av.value))
 	copy(dst, av.value)
 	return dst
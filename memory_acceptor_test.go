@@ -1,3 +1,114 @@
 package caspaxos
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
 var _ Acceptor = (*MemoryAcceptor)(nil)
+
+func TestAcceptorOnChosen(t *testing.T) {
+	type event struct {
+		key   string
+		b     Ballot
+		value string
+	}
+	var (
+		mtx    sync.Mutex
+		events []event
+	)
+	onChosen := AcceptorOnChosen(func(key string, b Ballot, value []byte) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		events = append(events, event{key, b, string(value)})
+	})
+
+	var (
+		a   = NewMemoryAcceptor("1", onChosen)
+		ctx = context.Background()
+		b1  = Ballot{Counter: 1, ID: 1}
+		b2  = Ballot{Counter: 2, ID: 1}
+	)
+	a.Prepare(ctx, "k", b1)
+	if err := a.Accept(ctx, "k", b1, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Accept(ctx, "k", Ballot{ID: 2}, []byte("y")); err == nil {
+		t.Fatal("stale accept: want conflict, have none") // must not fire
+	}
+	a.Prepare(ctx, "k", b2)
+	if err := a.Accept(ctx, "k", b2, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if want, have := 2, len(events); want != have {
+		t.Fatalf("events: want %d, have %d", want, have)
+	}
+	for i, e := range events {
+		if e.key != "k" || e.value != "x" {
+			t.Errorf("event %d: want k=x, have %s=%s", i+1, e.key, e.value)
+		}
+	}
+	if !events[1].b.greaterThan(events[0].b) {
+		t.Errorf("events out of order: %s, then %s", events[0].b, events[1].b)
+	}
+}
+
+// Run with e.g. -cpu 1,4,16 to see how throughput scales with concurrency.
+// Distinct keys mostly land on different shards; a single key can't scale.
+func BenchmarkMemoryAcceptorParallel(b *testing.B) {
+	for name, keyFunc := range map[string]func(worker int64) string{
+		"distinct": func(worker int64) string { return fmt.Sprintf("key-%d", worker) },
+		"same":     func(worker int64) string { return "key" },
+	} {
+		keyFunc := keyFunc
+		b.Run(name, func(b *testing.B) {
+			var (
+				a      = NewMemoryAcceptor("1")
+				ctx    = context.Background()
+				value  = []byte("value")
+				worker int64
+			)
+			b.RunParallel(func(pb *testing.PB) {
+				var (
+					key = keyFunc(atomic.AddInt64(&worker, 1))
+					id  = uint64(atomic.LoadInt64(&worker))
+					c   uint64
+				)
+				for pb.Next() {
+					c++
+					bal := Ballot{Counter: c, ID: id}
+					a.Prepare(ctx, key, bal)
+					a.Accept(ctx, key, bal, value)
+				}
+			})
+		})
+	}
+}
+
+func TestAcceptorOnKeyEvent(t *testing.T) {
+	var (
+		events []string
+		m      = newTestMetrics()
+		a      = NewMemoryAcceptor("1", AcceptorMetrics(m), AcceptorOnKeyEvent(func(key string, event KeyEvent) {
+			events = append(events, key+"="+string(event))
+		}))
+		ctx = context.Background()
+	)
+	for i, key := range []string{"a", "a", "b"} {
+		if err := a.Accept(ctx, key, Ballot{Counter: uint64(i + 1), ID: 1}, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := "[a=created a=updated b=created]", fmt.Sprint(events); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+	if want, have := 2.0, m.value("key_events|event|created"); want != have {
+		t.Errorf("created: want %v, have %v", want, have)
+	}
+}
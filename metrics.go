@@ -0,0 +1,55 @@
+package caspaxos
+
+// Metrics is a minimal metrics provider, which proposers and acceptors use to
+// create their instruments. It's deliberately small, so that any metrics
+// backend can be adapted to it without the core package depending on one.
+// Implementations should return usable instruments for any name.
+type Metrics interface {
+	Counter(name string) Counter
+	Gauge(name string) Gauge
+	Histogram(name string) Histogram
+}
+
+// Counter models a monotonically increasing value.
+type Counter interface {
+	With(labelValues ...string) Counter
+	Add(delta float64)
+}
+
+// Gauge models a value that can go up and down.
+type Gauge interface {
+	With(labelValues ...string) Gauge
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram models a distribution of observed values.
+type Histogram interface {
+	With(labelValues ...string) Histogram
+	Observe(value float64)
+}
+
+// NopMetrics returns a Metrics whose instruments do nothing. It's the default.
+func NopMetrics() Metrics { return nopMetrics{} }
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string) Counter     { return nopCounter{} }
+func (nopMetrics) Gauge(string) Gauge         { return nopGauge{} }
+func (nopMetrics) Histogram(string) Histogram { return nopHistogram{} }
+
+type nopCounter struct{}
+
+func (c nopCounter) With(...string) Counter { return c }
+func (nopCounter) Add(float64)              {}
+
+type nopGauge struct{}
+
+func (g nopGauge) With(...string) Gauge { return g }
+func (nopGauge) Set(float64)            {}
+func (nopGauge) Add(float64)            {}
+
+type nopHistogram struct{}
+
+func (h nopHistogram) With(...string) Histogram { return h }
+func (nopHistogram) Observe(float64)            {}
@@ -0,0 +1,121 @@
+package caspaxos
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMetrics(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		pm     = newTestMetrics()
+		am     = newTestMetrics()
+		a1     = NewMemoryAcceptor("1", AcceptorMetrics(am))
+		a2     = NewMemoryAcceptor("2", AcceptorMetrics(am))
+		a3     = NewMemoryAcceptor("3", AcceptorMetrics(am))
+		p1     = NewLocalProposerWithOptions(1, logger, []Acceptor{a1, a2, a3}, ProposerMetrics(pm))
+		ctx    = context.Background()
+	)
+
+	p1.Propose(ctx, "a", changeFuncInitializeOnlyOnce("x"))
+	p1.Propose(ctx, "b", changeFuncInitializeOnlyOnce("y"))
+
+	if want, have := 2.0, pm.value("proposes"); want != have {
+		t.Errorf("proposes: want %v, have %v", want, have)
+	}
+	if want, have := 2.0, pm.count("propose_duration_seconds|success|true"); want != have {
+		t.Errorf("propose_duration_seconds: want %v observations, have %v", want, have)
+	}
+	var observed float64
+	for _, addr := range []string{"1", "2", "3"} {
+		observed += pm.count("acceptor_duration_seconds|acceptor|" + addr + "|phase|prepare")
+	}
+	if min := 2.0 * 2; observed < min {
+		t.Errorf("acceptor_duration_seconds: want at least %v prepare observations, have %v", min, observed)
+	}
+	if want, have := 3.0, pm.value("preparers"); want != have {
+		t.Errorf("preparers: want %v, have %v", want, have)
+	}
+	if min, have := 2.0*2, am.value("prepares|result|confirm"); have < min {
+		t.Errorf("prepares: want at least %v, have %v", min, have)
+	}
+	if want, have := 2.0, am.value("keys"); want != have {
+		t.Errorf("keys: want %v, have %v", want, have)
+	}
+}
+
+// testMetrics records the last value (or running total) of every instrument,
+// keyed by name and label values, joined with "|".
+type testMetrics struct {
+	mtx    sync.Mutex
+	values map[string]float64
+	counts map[string]float64
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		values: map[string]float64{},
+		counts: map[string]float64{},
+	}
+}
+
+func (m *testMetrics) value(key string) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.values[key]
+}
+
+func (m *testMetrics) count(key string) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.counts[key]
+}
+
+func (m *testMetrics) Counter(name string) Counter     { return testCounter{testInstrument{m, name}} }
+func (m *testMetrics) Gauge(name string) Gauge         { return testGauge{testInstrument{m, name}} }
+func (m *testMetrics) Histogram(name string) Histogram { return testHistogram{testInstrument{m, name}} }
+
+type testInstrument struct {
+	m   *testMetrics
+	key string
+}
+
+func (i testInstrument) with(labelValues []string) testInstrument {
+	return testInstrument{i.m, strings.Join(append([]string{i.key}, labelValues...), "|")}
+}
+
+func (i testInstrument) update(f func(values, counts map[string]float64)) {
+	i.m.mtx.Lock()
+	defer i.m.mtx.Unlock()
+	f(i.m.values, i.m.counts)
+}
+
+func (i testInstrument) Add(delta float64) {
+	i.update(func(values, counts map[string]float64) { values[i.key] += delta; counts[i.key]++ })
+}
+
+func (i testInstrument) Set(value float64) {
+	i.update(func(values, counts map[string]float64) { values[i.key] = value; counts[i.key]++ })
+}
+
+func (i testInstrument) Observe(value float64) {
+	i.update(func(values, counts map[string]float64) { values[i.key] = value; counts[i.key]++ })
+}
+
+type testCounter struct{ testInstrument }
+
+func (c testCounter) With(labelValues ...string) Counter { return testCounter{c.with(labelValues)} }
+
+type testGauge struct{ testInstrument }
+
+func (g testGauge) With(labelValues ...string) Gauge { return testGauge{g.with(labelValues)} }
+
+type testHistogram struct{ testInstrument }
+
+func (h testHistogram) With(labelValues ...string) Histogram {
+	return testHistogram{h.with(labelValues)}
+}
@@ -0,0 +1,105 @@
+package caspaxos
+
+import (
+	"sort"
+	"time"
+)
+
+// PlacementPolicy decides which acceptors a proposer contacts in each phase.
+// Policies can e.g. prefer nearby or cheap acceptors, and avoid sending
+// requests to the rest, at the cost of less redundancy.
+type PlacementPolicy interface {
+	// Place returns the subset of candidates to contact first in the phase,
+	// which is "prepare", "accept", or "confirm". Candidates on probation have
+	// already been removed. The quorum is the one the phase must reach; it
+	// shouldn't be modified. If the returned acceptors can't possibly form a
+	// quorum, the proposer contacts every candidate instead. Otherwise, the
+	// candidates passed over are contacted only once failures make quorum
+	// impossible without them, or after the hedge delay set with
+	// ProposerPlacementHedge.
+	Place(phase string, candidates []string, quorum Quorum) []string
+}
+
+// BroadcastPlacement returns the default placement policy, which contacts
+// every candidate, and lets the fastest quorum win.
+func BroadcastPlacement() PlacementPolicy { return broadcastPlacement{} }
+
+type broadcastPlacement struct{}
+
+func (broadcastPlacement) Place(phase string, candidates []string, quorum Quorum) []string {
+	return candidates
+}
+
+// ProximityPlacement returns a placement policy which prefers near acceptors.
+// The proximity map tags acceptor addresses with their distance from the
+// proposer, e.g. 0 for the same host, 1 for the same zone, and 2 for another
+// zone; acceptors that aren't tagged are farther than any that are. Each phase
+// contacts the nearest acceptors that can reach quorum, including every
+// acceptor at the farthest distance needed, so the fastest quorum among them
+// still wins. The rest are contacted only when they're needed.
+func ProximityPlacement(proximity map[string]int) PlacementPolicy {
+	return proximityPlacement(proximity)
+}
+
+type proximityPlacement map[string]int
+
+func (p proximityPlacement) Place(phase string, candidates []string, quorum Quorum) []string {
+	sorted := make([]string, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return p.distance(sorted[i]) < p.distance(sorted[j])
+	})
+
+	excluded := make(map[string]bool, len(sorted))
+	for _, addr := range sorted {
+		excluded[addr] = true
+	}
+	for i := 0; i < len(sorted); {
+		// Add the whole tier at the next distance.
+		d := p.distance(sorted[i])
+		for ; i < len(sorted) && p.distance(sorted[i]) == d; i++ {
+			delete(excluded, sorted[i])
+		}
+		if quorum.PossibleWithout(excluded) {
+			return sorted[:i]
+		}
+	}
+	return sorted
+}
+
+func (p proximityPlacement) distance(addr string) int {
+	if d, ok := p[addr]; ok {
+		return d
+	}
+	return int(^uint(0) >> 1) // untagged acceptors are the farthest
+}
+
+// fanout tracks the acceptors contacted during one phase of a proposal. It's
+// created by LocalProposer.fanout.
+type fanout struct {
+	quorum  Quorum
+	send    func(addr string)
+	standby []string        // not contacted yet
+	out     map[string]bool // can't confirm: skipped, in standby, or failed
+	pending int             // contacted, and yet to respond
+	hedge   <-chan time.Time
+}
+
+// failed records that the acceptor at addr didn't confirm, and contacts the
+// acceptors in standby if quorum is no longer possible without them.
+func (f *fanout) failed(addr string) {
+	f.out[addr] = true
+	if !f.quorum.PossibleWithout(f.out) {
+		f.expand()
+	}
+}
+
+// expand contacts the acceptors in standby.
+func (f *fanout) expand() {
+	for _, addr := range f.standby {
+		delete(f.out, addr)
+		f.pending++
+		f.send(addr)
+	}
+	f.standby, f.hedge = nil, nil
+}
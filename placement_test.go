@@ -0,0 +1,140 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+var _ PlacementPolicy = BroadcastPlacement()
+
+func TestPlacementPolicy(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		ctx    = context.Background()
+		a1     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("1")}
+		a2     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("2")}
+		a3     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("3")}
+	)
+
+	// Skipping one of three acceptors still leaves a quorum, so it's never
+	// contacted.
+	p1 := NewLocalProposerWithOptions(1, logger, []Acceptor{a1, a2, a3}, ProposerPlacementPolicy(skipPlacement{"3": true}))
+	if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+		t.Fatal(err)
+	}
+	if n := a3.callCount(); n != 0 {
+		t.Errorf("skipped acceptor was called %d time(s)", n)
+	}
+
+	// Skipping two of three can't reach quorum, so every acceptor is
+	// contacted instead.
+	p2 := NewLocalProposerWithOptions(2, logger, []Acceptor{a1, a2, a3}, ProposerPlacementPolicy(skipPlacement{"2": true, "3": true}))
+	if _, err := p2.Propose(ctx, "k", changeFuncRead); err != nil {
+		t.Fatal(err)
+	}
+	if n := a3.callCount(); n == 0 {
+		t.Errorf("insufficient placement: want fallback to every acceptor, but acceptor 3 wasn't called")
+	}
+}
+
+func TestProximityPlacement(t *testing.T) {
+	var (
+		candidates = []string{"1", "2", "3", "4", "5"}
+		quorum     = MajorityQuorum().Quorum(candidates)
+		proximity  = map[string]int{"1": 0, "2": 0, "3": 1, "4": 1}
+		placed     = ProximityPlacement(proximity).Place("prepare", candidates, quorum)
+	)
+	sort.Strings(placed)
+	if want, have := "[1 2 3 4]", fmt.Sprint(placed); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestPlacementStandby(t *testing.T) {
+	var (
+		logger    = log.NewLogfmtLogger(testWriter{t})
+		ctx       = context.Background()
+		proximity = map[string]int{"1": 0, "2": 0}
+	)
+
+	// Healthy near acceptors reach quorum on their own.
+	{
+		a1 := &flakyAcceptor{Acceptor: NewMemoryAcceptor("1")}
+		a2 := &flakyAcceptor{Acceptor: NewMemoryAcceptor("2")}
+		a3 := &flakyAcceptor{Acceptor: NewMemoryAcceptor("3")}
+		p := NewLocalProposerWithOptions(1, logger, []Acceptor{a1, a2, a3}, ProposerPlacementPolicy(ProximityPlacement(proximity)))
+		if _, err := p.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+			t.Fatal(err)
+		}
+		if n := a3.callCount(); n != 0 {
+			t.Errorf("healthy: far acceptor was called %d time(s)", n)
+		}
+	}
+
+	// A failed near acceptor brings in the far one.
+	{
+		a1 := &flakyAcceptor{Acceptor: NewMemoryAcceptor("1")}
+		a2 := &flakyAcceptor{Acceptor: NewMemoryAcceptor("2")}
+		a3 := &flakyAcceptor{Acceptor: NewMemoryAcceptor("3")}
+		a1.setFailing(true)
+		p := NewLocalProposerWithOptions(1, logger, []Acceptor{a1, a2, a3}, ProposerPlacementPolicy(ProximityPlacement(proximity)))
+		if _, err := p.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+			t.Fatal(err)
+		}
+		if n := a3.callCount(); n == 0 {
+			t.Errorf("failure: far acceptor wasn't called")
+		}
+	}
+
+	// A slow near acceptor brings in the far one after the hedge delay.
+	{
+		a1 := &gatedAcceptor{MemoryAcceptor: NewMemoryAcceptor("1"), key: "k", gate: make(chan struct{})}
+		a2 := NewMemoryAcceptor("2")
+		a3 := NewMemoryAcceptor("3")
+		defer close(a1.gate)
+		p := NewLocalProposerWithOptions(1, logger, []Acceptor{a1, a2, a3},
+			ProposerPlacementPolicy(ProximityPlacement(proximity)),
+			ProposerPlacementHedge(10*time.Millisecond),
+		)
+		if _, err := p.Propose(ctx, "k", changeFuncInitializeOnlyOnce("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuorumPolicy(t *testing.T) {
+	q := MajorityQuorum().Quorum([]string{"1", "2", "3"}, []string{"3", "4", "5"})
+	if q.PossibleWithout(map[string]bool{"4": true, "5": true}) {
+		t.Errorf("joint quorum possible without a majority of the new group")
+	}
+	for _, addr := range []string{"1", "3"} {
+		q.Confirm(addr)
+	}
+	if q.Reached() {
+		t.Errorf("joint quorum reached with a majority of only the old group")
+	}
+	if q.PossibleWithout(map[string]bool{"2": true, "4": true, "5": true}) {
+		t.Errorf("joint quorum possible without any more of the new group")
+	}
+	q.Confirm("4")
+	if !q.Reached() {
+		t.Errorf("joint quorum not reached with a majority of both groups")
+	}
+}
+
+type skipPlacement map[string]bool
+
+func (s skipPlacement) Place(phase string, candidates []string, quorum Quorum) []string {
+	var placed []string
+	for _, addr := range candidates {
+		if !s[addr] {
+			placed = append(placed, addr)
+		}
+	}
+	return placed
+}
@@ -0,0 +1,106 @@
+package caspaxos
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ProposerProbation enables acceptor probation. An acceptor which fails
+// threshold consecutive requests (conflicts don't count) is put on probation,
+// and excluded from fan-out for the given interval, as long as enough other
+// acceptors remain to reach quorum. Once the interval elapses, the acceptor is
+// included in the next fan-out as a probe; if that succeeds, the acceptor is
+// reinstated, otherwise its probation is extended. This avoids paying for
+// timeouts to a dead acceptor on every proposal during an extended outage.
+// By default, probation is disabled.
+func ProposerProbation(threshold int, interval time.Duration) ProposerOption {
+	return func(p *LocalProposer) {
+		if threshold <= 0 {
+			p.probation = nil
+			return
+		}
+		p.probation = &probation{
+			threshold: threshold,
+			interval:  interval,
+			failures:  map[string]int{},
+			until:     map[string]time.Time{},
+			now:       time.Now,
+		}
+	}
+}
+
+// probation tracks acceptor failures for a proposer. A nil probation is valid,
+// and never excludes anything.
+type probation struct {
+	mtx       sync.Mutex
+	threshold int
+	interval  time.Duration
+	failures  map[string]int
+	until     map[string]time.Time
+	now       func() time.Time
+	logger    Logger
+}
+
+// exclude returns the subset of addrs which are on probation, and shouldn't be
+// contacted. If excluding them would make quorum impossible, nothing is
+// excluded.
+func (pb *probation) exclude(addrs []string, q Quorum) map[string]bool {
+	if pb == nil {
+		return nil
+	}
+
+	pb.mtx.Lock()
+	defer pb.mtx.Unlock()
+
+	var (
+		now      = pb.now()
+		excluded = map[string]bool{}
+	)
+	for _, addr := range addrs {
+		if until, ok := pb.until[addr]; ok && now.Before(until) {
+			excluded[addr] = true
+		}
+	}
+	if !q.PossibleWithout(excluded) {
+		return nil
+	}
+	return excluded
+}
+
+// observe records the result of a request to the acceptor at addr.
+func (pb *probation) observe(addr string, err error) {
+	if pb == nil {
+		return
+	}
+	if _, ok := err.(ConflictError); ok {
+		err = nil // a conflict is a perfectly healthy response
+	}
+	if err == context.Canceled {
+		return // we gave up on the request; it says nothing about the acceptor
+	}
+
+	pb.mtx.Lock()
+	defer pb.mtx.Unlock()
+
+	_, onProbation := pb.until[addr]
+
+	if err == nil {
+		delete(pb.failures, addr)
+		if onProbation {
+			delete(pb.until, addr)
+			pb.logger.Log(LevelKey, LevelInfo, "acceptor", addr, "probation", "reinstated")
+		}
+		return
+	}
+
+	pb.failures[addr]++
+	switch {
+	case onProbation:
+		pb.until[addr] = pb.now().Add(pb.interval)
+		pb.logger.Log(LevelKey, LevelDebug, "acceptor", addr, "probation", "extended", "err", err)
+	case pb.failures[addr] >= pb.threshold:
+		pb.until[addr] = pb.now().Add(pb.interval)
+		pb.logger.Log(LevelKey, LevelWarn, "acceptor", addr, "probation", "demoted", "failures", pb.failures[addr], "err", err)
+	}
+}
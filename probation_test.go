@@ -0,0 +1,138 @@
+package caspaxos
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestProbation(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = NewMemoryAcceptor("4")
+		a5     = &flakyAcceptor{Acceptor: NewMemoryAcceptor("5")}
+		p1     = NewLocalProposerWithOptions(1, logger, []Acceptor{a1, a2, a3, a4, a5}, ProposerProbation(2, time.Minute))
+		clock  = &fakeClock{t: time.Now()}
+		ctx    = context.Background()
+	)
+	p1.probation.now = clock.now
+
+	// Make a5 fail. After a few proposals, it should be demoted, and stop
+	// receiving requests altogether.
+	a5.setFailing(true)
+	for i := 0; i < 10; i++ {
+		if _, err := p1.Propose(ctx, "k", changeFuncRead); err != nil {
+			t.Fatalf("propose %d: %v", i+1, err)
+		}
+	}
+	before := a5.callCount()
+	for i := 0; i < 10; i++ {
+		p1.Propose(ctx, "k", changeFuncRead)
+	}
+	if want, have := before, a5.callCount(); want != have {
+		t.Fatalf("acceptor on probation: want %d calls, have %d", want, have)
+	}
+
+	// Heal a5. Once the probation interval elapses, it should be probed, and
+	// reinstated.
+	a5.setFailing(false)
+	clock.advance(2 * time.Minute)
+	for i := 0; i < 10; i++ {
+		p1.Propose(ctx, "k", changeFuncRead)
+	}
+	if have := a5.callCount(); have <= before {
+		t.Fatalf("acceptor after probation: want more than %d calls, have %d", before, have)
+	}
+	if excluded := p1.probation.exclude(addrs("1", "2", "3", "4", "5")); len(excluded) > 0 {
+		t.Fatalf("acceptor after probation: still excluded: %v", excluded)
+	}
+}
+
+func TestProbationRespectsQuorum(t *testing.T) {
+	pb := &probation{
+		threshold: 1,
+		interval:  time.Hour,
+		failures:  map[string]int{},
+		until:     map[string]time.Time{},
+		now:       time.Now,
+		logger:    NopLogger(),
+	}
+	pb.observe("1", errors.New("down"))
+	pb.observe("2", errors.New("down"))
+	pb.observe("3", ConflictError{}) // conflicts don't count
+
+	if excluded := pb.exclude(addrs("1", "2", "3")); len(excluded) > 0 {
+		t.Errorf("excluding %v would make quorum impossible", excluded)
+	}
+	if want, have := 2, len(pb.exclude(addrs("1", "2", "3", "4", "5"))); want != have {
+		t.Errorf("excluded: want %d, have %d", want, have)
+	}
+}
+
+// addrs returns its arguments, and a simple majority quorum over them.
+func addrs(a ...string) ([]string, Quorum) {
+	group := map[string]bool{}
+	for _, addr := range a {
+		group[addr] = true
+	}
+	return a, newQuorum(group)
+}
+
+type fakeClock struct {
+	mtx sync.Mutex
+	t   time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.t = c.t.Add(d)
+}
+
+type flakyAcceptor struct {
+	Acceptor
+	failing int32
+	calls   int64
+}
+
+var errFlaky = errors.New("flaky acceptor failure")
+
+func (a *flakyAcceptor) setFailing(failing bool) {
+	var v int32
+	if failing {
+		v = 1
+	}
+	atomic.StoreInt32(&a.failing, v)
+}
+
+func (a *flakyAcceptor) callCount() int64 { return atomic.LoadInt64(&a.calls) }
+
+func (a *flakyAcceptor) Prepare(ctx context.Context, key string, b Ballot) ([]byte, Ballot, error) {
+	atomic.AddInt64(&a.calls, 1)
+	if atomic.LoadInt32(&a.failing) == 1 {
+		return nil, Ballot{}, errFlaky
+	}
+	return a.Acceptor.Prepare(ctx, key, b)
+}
+
+func (a *flakyAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	atomic.AddInt64(&a.calls, 1)
+	if atomic.LoadInt32(&a.failing) == 1 {
+		return errFlaky
+	}
+	return a.Acceptor.Accept(ctx, key, b, value)
+}
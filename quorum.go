@@ -0,0 +1,101 @@
+package caspaxos
+
+// Quorum tracks confirmations from acceptors during a single phase of a
+// proposal.
+type Quorum interface {
+	// Confirm records a confirmation from the acceptor at addr.
+	Confirm(addr string)
+
+	// Reached returns true once enough acceptors have confirmed.
+	Reached() bool
+
+	// PossibleWithout returns true if the quorum could still be reached
+	// without further confirmations from any of the excluded acceptors.
+	PossibleWithout(excluded map[string]bool) bool
+}
+
+// QuorumPolicy decides which sets of acceptors constitute a quorum. For safety,
+// any two quorums a policy produces for the same groups must intersect; a
+// majority of every group is the simplest policy with that property.
+type QuorumPolicy interface {
+	// Quorum returns a new Quorum for one phase. Normally, there's a single
+	// group, comprising every acceptor in the phase; during a joint
+	// configuration change, there's one group for each configuration, and a
+	// quorum must include a quorum of each group.
+	Quorum(groups ...[]string) Quorum
+}
+
+// MajorityQuorum returns the default quorum policy, which is reached once a
+// majority of every group has confirmed.
+func MajorityQuorum() QuorumPolicy { return majorityPolicy{} }
+
+type majorityPolicy struct{}
+
+func (majorityPolicy) Quorum(groups ...[]string) Quorum {
+	sets := make([]map[string]bool, len(groups))
+	for i, group := range groups {
+		sets[i] = make(map[string]bool, len(group))
+		for _, addr := range group {
+			sets[i][addr] = true
+		}
+	}
+	return newQuorum(sets...)
+}
+
+// quorum is a majority quorum over one or more groups.
+type quorum struct {
+	groups    []map[string]bool
+	need      []int
+	confirmed map[string]bool
+}
+
+func newQuorum(groups ...map[string]bool) *quorum {
+	q := &quorum{
+		groups:    groups,
+		need:      make([]int, len(groups)),
+		confirmed: map[string]bool{},
+	}
+	for i, group := range groups {
+		q.need[i] = (len(group) / 2) + 1
+	}
+	return q
+}
+
+// Confirm implements Quorum.
+func (q *quorum) Confirm(addr string) {
+	if q.confirmed[addr] {
+		return
+	}
+	q.confirmed[addr] = true
+	for i, group := range q.groups {
+		if group[addr] {
+			q.need[i]--
+		}
+	}
+}
+
+// Reached implements Quorum.
+func (q *quorum) Reached() bool {
+	for _, n := range q.need {
+		if n > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PossibleWithout implements Quorum.
+func (q *quorum) PossibleWithout(excluded map[string]bool) bool {
+	for i, group := range q.groups {
+		var available int
+		for addr := range group {
+			if !excluded[addr] && !q.confirmed[addr] {
+				available++
+			}
+		}
+		if available < q.need[i] {
+			return false
+		}
+	}
+	return true
+}
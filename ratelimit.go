@@ -0,0 +1,85 @@
+package caspaxos
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited indicates a change to a key was refused because the key has
+// been changed too often recently.
+var ErrRateLimited = errors.New("too many changes to key")
+
+// ProposerKeyRateLimit limits the number of changes to any single key to limit
+// per interval, protecting the cluster from one pathological key dominating
+// resources. Only proposals which change the value count; reads, i.e.
+// proposals whose change function returns the current value, don't. The quota
+// is checked before the prepare phase, so a refused proposal isn't sent to the
+// acceptors at all, and doesn't disturb other proposers' promises; Propose
+// returns ErrRateLimited. A read can't be told apart from a change until after
+// the prepare phase, so while a key's quota is exhausted, reads of it are
+// refused, too. Combine with ProposerValidator and MaxValueSize to also limit
+// value sizes. By default, changes aren't limited.
+func ProposerKeyRateLimit(limit int, interval time.Duration) ProposerOption {
+	return func(p *LocalProposer) {
+		p.limiter = &keyRateLimiter{
+			limit:    limit,
+			interval: interval,
+			now:      time.Now,
+			windows:  map[string]*rateWindow{},
+		}
+	}
+}
+
+// keyRateLimiter counts changes per key in fixed windows. A nil keyRateLimiter
+// is valid, and allows everything.
+type keyRateLimiter struct {
+	mtx       sync.Mutex
+	limit     int
+	interval  time.Duration
+	now       func() time.Time
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// reserve takes a change to key from its quota, and returns a function which
+// gives it back, e.g. if the proposal turns out to be a read. It returns false
+// if the quota is exhausted.
+func (l *keyRateLimiter) reserve(key string) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > l.interval {
+		for k, w := range l.windows {
+			if now.Sub(w.start) > l.interval {
+				delete(l.windows, k) // expired windows would be reset anyway
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) > l.interval {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.count >= l.limit {
+		return nil, false
+	}
+	w.count++
+	return func() {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		w.count-- // a window that's been replaced is simply discarded
+	}, true
+}
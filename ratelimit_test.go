@@ -0,0 +1,63 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProposerKeyRateLimit(t *testing.T) {
+	var (
+		a1    = NewMemoryAcceptor("1")
+		a2    = NewMemoryAcceptor("2")
+		a3    = NewMemoryAcceptor("3")
+		p1    = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerKeyRateLimit(2, time.Minute))
+		clock = &fakeClock{t: time.Now()}
+		ctx   = context.Background()
+	)
+	p1.limiter.now = clock.now
+
+	write := func(key string, i int) error {
+		_, err := p1.Propose(ctx, key, func([]byte) []byte { return []byte(fmt.Sprint(i)) })
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		// Reads don't count.
+		if _, err := p1.Propose(ctx, "hot", changeFuncRead); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if err := write("hot", i); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	// Over the limit, proposals are refused before the prepare phase, so no
+	// acceptor promises their ballots.
+	_, b, err := p1.ProposeBallot(ctx, "hot", func([]byte) []byte { return []byte("2") })
+	if want, have := ErrRateLimited, err; want != have {
+		t.Fatalf("write over limit: want %v, have %v", want, have)
+	}
+	for _, a := range []*MemoryAcceptor{a1, a2, a3} {
+		s := a.shard("hot")
+		s.mtx.Lock()
+		if s.values["hot"].promise == b {
+			t.Errorf("acceptor %s: promised the refused ballot %v", a.Address(), b)
+		}
+		s.mtx.Unlock()
+	}
+	if _, err := p1.Propose(ctx, "hot", changeFuncRead); err != ErrRateLimited {
+		t.Errorf("read over limit: want %v, have %v", ErrRateLimited, err)
+	}
+
+	// Other keys aren't limited.
+	if err := write("cold", 0); err != nil {
+		t.Errorf("other key: %v", err)
+	}
+
+	// The limit resets after the interval.
+	clock.advance(2 * time.Minute)
+	if err := write("hot", 3); err != nil {
+		t.Errorf("write after interval: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AcceptedReader models an acceptor which can report the value it has accepted
+// for a key, without changing any of its state. ReplaceAcceptor requires it of
+// the new acceptor, to verify the copy.
+type AcceptedReader interface {
+	Accepted(ctx context.Context, key string) (value []byte, accepted Ballot, err error)
+}
+
+// ErrAcceptedReadUnsupported indicates that ReplaceAcceptor was called with a
+// new acceptor which doesn't implement AcceptedReader.
+var ErrAcceptedReadUnsupported = errors.New("acceptor doesn't support reading accepted values")
+
+// ReplaceStep is a step of ReplaceAcceptor.
+type ReplaceStep int
+
+// The steps of ReplaceAcceptor, in order.
+const (
+	ReplaceAdd    ReplaceStep = iota // grow the cluster with the new acceptor
+	ReplaceCopy                      // rewrite every key, which sends it to the new acceptor
+	ReplaceVerify                    // check the new acceptor holds every key
+	ReplaceRemove                    // shrink the cluster by the old acceptor
+	ReplaceDone
+)
+
+func (s ReplaceStep) String() string {
+	switch s {
+	case ReplaceAdd:
+		return "add"
+	case ReplaceCopy:
+		return "copy"
+	case ReplaceVerify:
+		return "verify"
+	case ReplaceRemove:
+		return "remove"
+	case ReplaceDone:
+		return "done"
+	default:
+		return fmt.Sprintf("ReplaceStep(%d)", int(s))
+	}
+}
+
+// Replacement is the progress of ReplaceAcceptor. The zero value is a
+// replacement that hasn't started.
+type Replacement struct {
+	Step  ReplaceStep
+	Done  int // keys finished in the current step
+	Total int // keys in the current step, or 0 for steps without keys
+}
+
+// ReplaceProgressFunc receives the progress of ReplaceAcceptor, after each
+// key, and at the start of each step. Persist it to resume the replacement
+// after a failure or restart.
+type ReplaceProgressFunc func(Replacement)
+
+// ReplaceAcceptor replaces the from acceptor with the to acceptor, in every
+// proposer, as a single workflow. It grows the cluster with the to acceptor,
+// copies every key to it via the identity transaction, verifies that it holds
+// every key, and finally shrinks the cluster by the from acceptor. A
+// LocalProposer waits for its in-flight proposals before removing an acceptor,
+// so the from acceptor is drained by the time ReplaceAcceptor returns.
+//
+// The replacement is resumable. The workflow starts from, and updates, the
+// given Replacement; if it fails, call ReplaceAcceptor again with the same
+// Replacement, acceptors, keys and proposers, and it continues from the step
+// and key where it stopped. The add and remove steps skip the proposers which
+// have already made the change, so they're safe to retry, even if the process
+// crashed partway through them. A nil progress func is allowed.
+//
+// As with ChangeConfiguration, the keys must include every key with a value
+// that should be copied to the new acceptor.
+func ReplaceAcceptor(ctx context.Context, r *Replacement, progress ReplaceProgressFunc, from, to Acceptor, keys []string, proposers ...Proposer) error {
+	if _, ok := to.(AcceptedReader); !ok {
+		return ErrAcceptedReadUnsupported
+	}
+	if progress == nil {
+		progress = func(Replacement) {}
+	}
+	identity := func(x []byte) []byte { return x }
+	advance := func(step ReplaceStep, total int) {
+		*r = Replacement{Step: step, Total: total}
+		progress(*r)
+	}
+
+	for r.Step != ReplaceDone {
+		switch r.Step {
+		case ReplaceAdd:
+			if err := GrowCluster(ctx, to, proposers...); err != nil {
+				return errors.Wrap(err, "during replace step 1 (add)")
+			}
+			advance(ReplaceCopy, len(keys))
+
+		case ReplaceCopy:
+			proposer := proposers[rand.Intn(len(proposers))]
+			for r.Done < len(keys) {
+				if _, err := proposer.Propose(ctx, keys[r.Done], identity); err != nil {
+					return errors.Wrapf(err, "during replace step 2 (copy of %q)", keys[r.Done])
+				}
+				r.Done++
+				progress(*r)
+			}
+			advance(ReplaceVerify, len(keys))
+
+		case ReplaceVerify:
+			// The copy only guarantees each key reached a quorum, which may
+			// not have included the new acceptor. So, compare the value the
+			// new acceptor holds with a quorum read, and copy again any key
+			// it's missing.
+			proposer := proposers[rand.Intn(len(proposers))]
+			for r.Done < len(keys) {
+				if err := verifyReplica(ctx, to, proposer, keys[r.Done]); err != nil {
+					return errors.Wrapf(err, "during replace step 3 (verify of %q)", keys[r.Done])
+				}
+				r.Done++
+				progress(*r)
+			}
+			advance(ReplaceRemove, 0)
+
+		case ReplaceRemove:
+			if err := ShrinkCluster(ctx, from, proposers...); err != nil {
+				return errors.Wrap(err, "during replace step 4 (remove)")
+			}
+			advance(ReplaceDone, 0)
+
+		default:
+			return fmt.Errorf("invalid replace step %s", r.Step)
+		}
+	}
+
+	return nil
+}
+
+// replaceVerifyTimeout bounds the verification of each key, if the context
+// has no deadline of its own.
+const replaceVerifyTimeout = 30 * time.Second
+
+// verifyReplica checks that the acceptor holds the current value of the key.
+// The value is read from a quorum with the identity transaction, which also
+// copies it to every accepter, and compared with the value the acceptor has
+// accepted. The read returns once a quorum has accepted, so the acceptor's own
+// accept may still be in flight; if the values differ, the check is repeated,
+// with backoff, until the context expires. The acceptor itself is only read,
+// so the check doesn't change its state. Keys with no value in the cluster are
+// trivially verified.
+func verifyReplica(ctx context.Context, target Acceptor, proposer Proposer, key string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, replaceVerifyTimeout)
+		defer cancel()
+	}
+	reader := target.(AcceptedReader)
+	for wait := 10 * time.Millisecond; ; wait *= 2 {
+		value, err := proposer.Propose(ctx, key, func(x []byte) []byte { return x })
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+		held, _, err := reader.Accepted(ctx, key)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(held, value) {
+			return nil
+		}
+		if wait > time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("%s doesn't hold the key: %v", target.Address(), ctx.Err())
+		}
+	}
+}
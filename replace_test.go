@@ -0,0 +1,201 @@
+package caspaxos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestReplaceAcceptor(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = NewMemoryAcceptor("4")
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+		ctx    = context.Background()
+		keys   = []string{"k1", "k2", "k3"}
+	)
+	for _, key := range keys {
+		if _, err := p1.Propose(ctx, key, changeFuncInitializeOnlyOnce("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first attempt fails partway through the copy.
+	var (
+		r        Replacement
+		reported []Replacement
+		progress = func(r Replacement) { reported = append(reported, r) }
+		failed   bool
+		flaky1   = &failOnceProposer{Proposer: p1, key: "k2", failed: &failed}
+		flaky2   = &failOnceProposer{Proposer: p2, key: "k2", failed: &failed}
+	)
+	if err := ReplaceAcceptor(ctx, &r, progress, a3, a4, keys, flaky1, flaky2); err == nil {
+		t.Fatal("first attempt: want error, have none")
+	}
+	if want, have := (Replacement{Step: ReplaceCopy, Done: 1, Total: 3}), r; want != have {
+		t.Fatalf("after failure: want %+v, have %+v", want, have)
+	}
+
+	// The second attempt resumes from the failed key.
+	if err := ReplaceAcceptor(ctx, &r, progress, a3, a4, keys, flaky1, flaky2); err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+	if want, have := ReplaceDone, r.Step; want != have {
+		t.Fatalf("want step %s, have %s", want, have)
+	}
+	if want, have := fmt.Sprint([]Replacement{
+		{ReplaceCopy, 0, 3}, {ReplaceCopy, 1, 3}, // first attempt
+		{ReplaceCopy, 2, 3}, {ReplaceCopy, 3, 3}, // second attempt
+		{ReplaceVerify, 0, 3}, {ReplaceVerify, 1, 3}, {ReplaceVerify, 2, 3}, {ReplaceVerify, 3, 3},
+		{ReplaceRemove, 0, 0}, {ReplaceDone, 0, 0},
+	}), fmt.Sprint(reported); want != have {
+		t.Errorf("progress: want %s, have %s", want, have)
+	}
+
+	// The new acceptor holds every value, and has replaced the old one.
+	for _, key := range keys {
+		if want, have := "v"+key, string(a4.dumpValue(key)); want != have {
+			t.Errorf("acceptor 4, %s: want %q, have %q", key, want, have)
+		}
+	}
+	for _, p := range []*LocalProposer{p1, p2} {
+		if _, ok := p.preparers["3"]; ok {
+			t.Errorf("old acceptor is still a preparer")
+		}
+		if _, ok := p.accepters["4"]; !ok {
+			t.Errorf("new acceptor isn't an accepter")
+		}
+		for _, key := range keys {
+			if value, err := p.Propose(ctx, key, changeFuncRead); err != nil {
+				t.Errorf("read %s: %v", key, err)
+			} else if want, have := "v"+key, string(value); want != have {
+				t.Errorf("read %s: want %q, have %q", key, want, have)
+			}
+		}
+	}
+}
+
+func TestReplaceAcceptorResume(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		a4     = NewMemoryAcceptor("4")
+		p1     = NewLocalProposer(1, log.With(logger, "p", 1), a1, a2, a3)
+		p2     = NewLocalProposer(2, log.With(logger, "p", 2), a1, a2, a3)
+		ctx    = context.Background()
+		keys   = []string{"k1"}
+	)
+	if _, err := p1.Propose(ctx, "k1", changeFuncInitializeOnlyOnce("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process crashed after the add step, before recording its progress.
+	if err := GrowCluster(ctx, a4, p1, p2); err != nil {
+		t.Fatal(err)
+	}
+	r := Replacement{Step: ReplaceAdd}
+	if err := ReplaceAcceptor(ctx, &r, nil, a3, a4, keys, p1, p2); err != nil {
+		t.Fatalf("resume after add: %v", err)
+	}
+
+	// A second replacement crashed partway through the remove step, when only
+	// one of the proposers had removed the old acceptor as a preparer.
+	if err := GrowCluster(ctx, a3, p1, p2); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.RemovePreparer(a1); err != nil {
+		t.Fatal(err)
+	}
+	r = Replacement{Step: ReplaceRemove}
+	if err := ReplaceAcceptor(ctx, &r, nil, a1, a3, keys, p1, p2); err != nil {
+		t.Fatalf("resume during remove: %v", err)
+	}
+	for _, p := range []*LocalProposer{p1, p2} {
+		for addr, want := range map[string]int{"1": 0, "3": 2, "4": 2} {
+			if have := p.has(addr); want != have {
+				t.Errorf("acceptor %s: want %d roles, have %d", addr, want, have)
+			}
+		}
+	}
+}
+
+func TestVerifyReplica(t *testing.T) {
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = &lateAcceptor{MemoryAcceptor: NewMemoryAcceptor("3"), gate: make(chan struct{})}
+		other  = NewMemoryAcceptor("other")
+		p1     = NewLocalProposer(1, logger, a1, a2, a3)
+		ctx    = context.Background()
+	)
+	if _, err := p1.Propose(ctx, "k", changeFuncInitializeOnlyOnce("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third acceptor's accepts land only after it's been checked a few
+	// times, as on a slow network.
+	if err := verifyReplica(ctx, a3, p1, "k"); err != nil {
+		t.Errorf("acceptor in the cluster: %v", err)
+	}
+	if err := verifyReplica(ctx, a3, p1, "missing"); err != nil {
+		t.Errorf("key without a value: %v", err)
+	}
+
+	// An acceptor outside the cluster never receives the value, and the check
+	// mustn't record anything in it.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := verifyReplica(ctx, other, p1, "k"); err == nil {
+		t.Errorf("acceptor outside the cluster: want error, have none")
+	}
+	if want, have := int64(0), atomic.LoadInt64(&other.count); want != have {
+		t.Errorf("acceptor outside the cluster: want %d keys, have %d", want, have)
+	}
+}
+
+// lateAcceptor holds its accepts until its accepted values have been read
+// twice.
+type lateAcceptor struct {
+	*MemoryAcceptor
+	reads int32
+	gate  chan struct{}
+}
+
+func (a *lateAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	<-a.gate
+	return a.MemoryAcceptor.Accept(ctx, key, b, value)
+}
+
+func (a *lateAcceptor) Accepted(ctx context.Context, key string) ([]byte, Ballot, error) {
+	value, b, err := a.MemoryAcceptor.Accepted(ctx, key)
+	if atomic.AddInt32(&a.reads, 1) == 2 {
+		close(a.gate)
+	}
+	return value, b, err
+}
+
+type failOnceProposer struct {
+	Proposer
+	key    string
+	failed *bool // shared, so only the first proposal for key fails
+}
+
+func (p *failOnceProposer) Propose(ctx context.Context, key string, f ChangeFunc) ([]byte, error) {
+	if key == p.key && !*p.failed {
+		*p.failed = true
+		return nil, errors.New("injected failure")
+	}
+	return p.Proposer.Propose(ctx, key, f)
+}
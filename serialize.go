@@ -0,0 +1,59 @@
+package caspaxos
+
+import (
+	"context"
+	"sync"
+)
+
+// SerializeKeys wraps a proposer so that concurrent proposals for the same key
+// run one at a time, in the order they arrive, rather than racing each other
+// as competing CAS attempts. This gives applications predictable
+// last-writer-wins semantics within a single proposer. Proposals for distinct
+// keys still run concurrently. Proposals from other proposers aren't affected.
+func SerializeKeys(next Proposer) Proposer {
+	return &keySerializer{
+		Proposer: next,
+		tails:    map[string]chan struct{}{},
+	}
+}
+
+type keySerializer struct {
+	Proposer
+
+	mtx   sync.Mutex
+	tails map[string]chan struct{} // key: closed when the last queued proposal finishes
+}
+
+// Propose implements Proposer. If the context is canceled while waiting in
+// the queue, Propose returns the context error, and the proposal isn't made.
+func (s *keySerializer) Propose(ctx context.Context, key string, f ChangeFunc) ([]byte, error) {
+	s.mtx.Lock()
+	prev, mine := s.tails[key], make(chan struct{})
+	s.tails[key] = mine
+	s.mtx.Unlock()
+
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			// Keep our place in the queue, so proposals behind us still wait
+			// for the ones ahead of us.
+			go func() { <-prev; s.done(key, mine) }()
+			return nil, ctx.Err()
+		}
+	}
+	defer s.done(key, mine)
+
+	return s.Proposer.Propose(ctx, key, f)
+}
+
+// done releases the next proposal for key, and forgets the key if the queue is
+// empty.
+func (s *keySerializer) done(key string, mine chan struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	close(mine)
+	if s.tails[key] == mine {
+		delete(s.tails, key)
+	}
+}
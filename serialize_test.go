@@ -0,0 +1,95 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSerializeKeys(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = SerializeKeys(NewLocalProposer(1, nil, a1, a2, a3))
+		ctx = context.Background()
+	)
+
+	// Every concurrent append succeeds, without any conflicts between them.
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := p1.Propose(ctx, "k", func(x []byte) []byte {
+				return append(append([]byte{}, x...), 'x')
+			}); err != nil {
+				t.Errorf("append %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	value, err := p1.Propose(ctx, "k", changeFuncRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := n, len(value); want != have {
+		t.Errorf("want %d appends, have %d", want, have)
+	}
+}
+
+func TestSerializeKeysOrder(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = SerializeKeys(NewLocalProposer(1, nil, a1, a2, a3))
+		ctx = context.Background()
+	)
+
+	// Hold the key with a slow first proposal, queue some others in a known
+	// order, and cancel one of them while it waits.
+	var (
+		release = make(chan struct{})
+		mtx     sync.Mutex
+		order   []string
+		wg      sync.WaitGroup
+	)
+	record := func(name string) ChangeFunc {
+		return func(x []byte) []byte {
+			mtx.Lock()
+			order = append(order, name)
+			mtx.Unlock()
+			return x
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p1.Propose(ctx, "k", func(x []byte) []byte { <-release; return record("first")(x) })
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	canceled, cancel := context.WithCancel(ctx)
+	for i, c := range []context.Context{ctx, canceled, ctx} {
+		name := fmt.Sprint(i)
+		wg.Add(1)
+		go func(c context.Context) {
+			defer wg.Done()
+			p1.Propose(c, "k", record(name))
+		}(c)
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if want, have := "[first 0 2]", fmt.Sprint(order); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
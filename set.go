@@ -0,0 +1,64 @@
+package caspaxos
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// A set register holds a sorted JSON array of distinct string members. The
+// functions below implement set semantics on top of ordinary ChangeFuncs, which
+// is useful for e.g. membership lists and tag sets. An empty value is an empty
+// set.
+
+// SetAdd returns a ChangeFunc which adds member to a set register. If the
+// current value isn't a valid set, it's left unchanged.
+func SetAdd(member string) ChangeFunc {
+	return func(current []byte) []byte {
+		members, err := SetMembers(current)
+		if err != nil {
+			return current
+		}
+		i := sort.SearchStrings(members, member)
+		if i < len(members) && members[i] == member {
+			return current
+		}
+		members = append(members, "")
+		copy(members[i+1:], members[i:])
+		members[i] = member
+		return encodeSet(members)
+	}
+}
+
+// SetRemove returns a ChangeFunc which removes member from a set register. If
+// the current value isn't a valid set, it's left unchanged.
+func SetRemove(member string) ChangeFunc {
+	return func(current []byte) []byte {
+		members, err := SetMembers(current)
+		if err != nil {
+			return current
+		}
+		i := sort.SearchStrings(members, member)
+		if i == len(members) || members[i] != member {
+			return current
+		}
+		return encodeSet(append(members[:i], members[i+1:]...))
+	}
+}
+
+// SetMembers decodes the sorted members of a set register.
+func SetMembers(value []byte) ([]string, error) {
+	if len(value) == 0 {
+		return []string{}, nil
+	}
+	var members []string
+	if err := json.Unmarshal(value, &members); err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func encodeSet(members []string) []byte {
+	buf, _ := json.Marshal(members)
+	return buf
+}
@@ -0,0 +1,40 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestSetRegister(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = NewLocalProposer(1, nil, a1, a2, a3)
+		ctx = context.Background()
+	)
+	for _, f := range []ChangeFunc{
+		SetAdd("b"), SetAdd("a"), SetAdd("c"), SetAdd("a"), SetRemove("b"), SetRemove("z"),
+	} {
+		if _, err := p1.Propose(ctx, "set", f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := p1.Propose(ctx, "set", changeFuncRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := SetMembers(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "[a c]", fmt.Sprint(members); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	if want, have := "garbage", string(SetAdd("a")([]byte("garbage"))); want != have {
+		t.Errorf("invalid set: want %q, have %q", want, have)
+	}
+}
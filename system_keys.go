@@ -0,0 +1,51 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+)
+
+// SystemKeyPrefix is reserved for internal state, like configuration,
+// checkpoints, and registries. Keys with this prefix should only be modified
+// by the components that own them.
+const SystemKeyPrefix = "__caspaxos/"
+
+// ErrSystemKey indicates an attempt to modify a reserved system key.
+var ErrSystemKey = errors.New("key is reserved for internal use")
+
+// ProtectSystemKeys wraps a proposer, e.g. one exposed via a public API, so
+// that it refuses to modify keys with SystemKeyPrefix. Reads of system keys are
+// still allowed: if the change function would modify the value, the current
+// value is kept, and Propose returns ErrSystemKey. Components that legitimately
+// manage system keys should use the underlying proposer directly.
+func ProtectSystemKeys(next Proposer) Proposer {
+	return systemKeyProtector{next}
+}
+
+type systemKeyProtector struct{ Proposer }
+
+// Propose implements Proposer.
+func (p systemKeyProtector) Propose(ctx context.Context, key string, f ChangeFunc) ([]byte, error) {
+	if !strings.HasPrefix(key, SystemKeyPrefix) {
+		return p.Proposer.Propose(ctx, key, f)
+	}
+
+	var refused bool
+	state, err := p.Proposer.Propose(ctx, key, func(current []byte) []byte {
+		next := f(current)
+		refused = !bytes.Equal(next, current) || (next == nil) != (current == nil)
+		if refused {
+			return current
+		}
+		return next
+	})
+	if err != nil {
+		return nil, err
+	}
+	if refused {
+		return nil, ErrSystemKey
+	}
+	return state, nil
+}
@@ -0,0 +1,33 @@
+package caspaxos
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProtectSystemKeys(t *testing.T) {
+	var (
+		a1       = NewMemoryAcceptor("1")
+		a2       = NewMemoryAcceptor("2")
+		a3       = NewMemoryAcceptor("3")
+		internal = NewLocalProposer(1, nil, a1, a2, a3)
+		public   = ProtectSystemKeys(NewLocalProposer(2, nil, a1, a2, a3))
+		ctx      = context.Background()
+		key      = SystemKeyPrefix + "config"
+	)
+	if _, err := internal.Propose(ctx, key, changeFuncInitializeOnlyOnce("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := public.Propose(ctx, key, func([]byte) []byte { return []byte("y") }); err != ErrSystemKey {
+		t.Errorf("write: want %v, have %v", ErrSystemKey, err)
+	}
+	if value, err := public.Propose(ctx, key, changeFuncRead); err != nil {
+		t.Errorf("read: %v", err)
+	} else if want, have := "x", string(value); want != have {
+		t.Errorf("read: want %q, have %q", want, have)
+	}
+	if _, err := public.Propose(ctx, "user/key", changeFuncInitializeOnlyOnce("z")); err != nil {
+		t.Errorf("ordinary key: %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package caspaxos
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TieredAcceptor keeps recently used keys in memory, and spills the least
+// recently used keys to disk once their total size exceeds a memory budget.
+// Keys are promoted back into memory when they're accessed. This gives
+// predictable RAM usage on large keyspaces, without making every operation
+// disk-bound.
+//
+// Spilled keys are written to a private temporary directory, which is removed
+// by Close. TieredAcceptor is therefore no more durable than MemoryAcceptor:
+// its state doesn't survive a restart.
+type TieredAcceptor struct {
+	mtx       sync.Mutex
+	addr      string
+	dir       string
+	budget    int
+	used      int
+	hot       map[string]*list.Element // key: element holding a *tieredEntry
+	lru       *list.List               // front is most recently used
+	cold      map[string]bool          // keys spilled to disk
+	watermark Ballot                   // greatest tombstone purged
+	chosen    ChosenFunc
+	events    keyEvents
+
+	prepares   Counter
+	accepts    Counter
+	keys       Gauge
+	spills     Counter
+	promotions Counter
+	memory     Gauge
+}
+
+type tieredEntry struct {
+	key string
+	av  acceptedValue
+}
+
+// Each ballot is three uint64s; the remaining overhead is a rough estimate of
+// the map, list, and struct bookkeeping for an in-memory entry.
+const tieredEntryOverhead = 2*3*8 + 64
+
+func (e *tieredEntry) size() int {
+	return len(e.key) + len(e.av.value) + tieredEntryOverhead
+}
+
+// NewTieredAcceptor returns an acceptor which keeps at most budget bytes of
+// keys and values in memory, and spills the rest to a new temporary directory
+// created within dir. If dir is empty, the system temporary directory is used.
+func NewTieredAcceptor(addr, dir string, budget int, options ...AcceptorOption) (*TieredAcceptor, error) {
+	tmp, err := ioutil.TempDir(dir, "caspaxos-tiered-")
+	if err != nil {
+		return nil, err
+	}
+	o := makeAcceptorOptions(options)
+	return &TieredAcceptor{
+		addr:       addr,
+		dir:        tmp,
+		budget:     budget,
+		hot:        map[string]*list.Element{},
+		lru:        list.New(),
+		cold:       map[string]bool{},
+		chosen:     o.onChosen,
+		events:     o.keyEvents(),
+		prepares:   o.metrics.Counter("prepares"),
+		accepts:    o.metrics.Counter("accepts"),
+		keys:       o.metrics.Gauge("keys"),
+		spills:     o.metrics.Counter("spills"),
+		promotions: o.metrics.Counter("promotions"),
+		memory:     o.metrics.Gauge("memory_bytes"),
+	}, nil
+}
+
+// Address implements Addresser.
+func (a *TieredAcceptor) Address() string {
+	return a.addr
+}
+
+// Prepare implements the first-phase responsibilities of an acceptor.
+func (a *TieredAcceptor) Prepare(ctx context.Context, key string, b Ballot) (value []byte, current Ballot, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, zeroballot, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if !a.exists(key) {
+		if err := belowWatermark(a.watermark, b); err != nil {
+			a.prepares.With("result", "conflict").Add(1)
+			return nil, a.watermark, err
+		}
+	}
+
+	e, err := a.load(key)
+	if err != nil {
+		return nil, zeroballot, err
+	}
+
+	if current, err = e.av.prepare(b); err != nil {
+		a.prepares.With("result", "conflict").Add(1)
+		a.evict() // best effort; a failed spill leaves the entry in memory
+		return e.av.value, current, err
+	}
+
+	a.prepares.With("result", "confirm").Add(1)
+	if err := a.evict(); err != nil {
+		return nil, zeroballot, err
+	}
+	return e.av.value, current, nil
+}
+
+// Accept implements the second-phase responsibilities of an acceptor.
+func (a *TieredAcceptor) Accept(ctx context.Context, key string, b Ballot, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if !a.exists(key) {
+		if err := belowWatermark(a.watermark, b); err != nil {
+			a.accepts.With("result", "conflict").Add(1)
+			return err
+		}
+	}
+
+	e, err := a.load(key)
+	if err != nil {
+		return err
+	}
+
+	before, prev := e.size(), e.av
+	if err := e.av.accept(b, value); err != nil {
+		a.accepts.With("result", "conflict").Add(1)
+		a.evict() // best effort; a failed spill leaves the entry in memory
+		return err
+	}
+	a.used += e.size() - before
+
+	a.accepts.With("result", "confirm").Add(1)
+	a.events.accepted(key, prev, value)
+	a.chosen(key, b, value)
+	return a.evict()
+}
+
+// Purge implements Purger.
+func (a *TieredAcceptor) Purge(ctx context.Context, key string, tombstone Ballot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if !a.exists(key) {
+		return nil
+	}
+	e, err := a.load(key)
+	if err != nil {
+		return err
+	}
+	if err := e.av.purge(tombstone); err != nil {
+		a.evict() // best effort; a failed spill leaves the entry in memory
+		return err
+	}
+
+	a.lru.Remove(a.hot[key])
+	delete(a.hot, key)
+	a.used -= e.size()
+	a.keys.Set(float64(len(a.hot) + len(a.cold)))
+	a.memory.Set(float64(a.used))
+	if tombstone.greaterThan(a.watermark) {
+		a.watermark = tombstone
+	}
+	a.events.purged(key)
+	return nil
+}
+
+// Accepted implements AcceptedReader. A spilled key is read from disk, but
+// isn't promoted back into memory.
+func (a *TieredAcceptor) Accepted(ctx context.Context, key string) (value []byte, accepted Ballot, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, zeroballot, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if elem, ok := a.hot[key]; ok {
+		e := elem.Value.(*tieredEntry)
+		return e.av.value, e.av.accepted, nil
+	}
+	if !a.cold[key] {
+		return nil, zeroballot, nil
+	}
+	buf, err := ioutil.ReadFile(a.filename(key))
+	if err != nil {
+		return nil, zeroballot, err
+	}
+	av, err := decodeAcceptedValue(key, buf)
+	if err != nil {
+		return nil, zeroballot, err
+	}
+	return av.value, av.accepted, nil
+}
+
+// Close removes the spill directory. The acceptor shouldn't be used afterwards.
+func (a *TieredAcceptor) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.hot, a.cold, a.used = map[string]*list.Element{}, map[string]bool{}, 0
+	a.lru.Init()
+	return os.RemoveAll(a.dir)
+}
+
+// exists returns true if the key is in memory or on disk. The caller must hold
+// the mutex.
+func (a *TieredAcceptor) exists(key string) bool {
+	_, ok := a.hot[key]
+	return ok || a.cold[key]
+}
+
+// load returns the in-memory entry for key, promoting it from disk or creating
+// it as necessary, and marks it as most recently used. The caller must hold
+// the mutex, and call evict afterwards.
+func (a *TieredAcceptor) load(key string) (*tieredEntry, error) {
+	if elem, ok := a.hot[key]; ok {
+		a.lru.MoveToFront(elem)
+		return elem.Value.(*tieredEntry), nil
+	}
+
+	e := &tieredEntry{key: key}
+	if a.cold[key] {
+		filename := a.filename(key)
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if e.av, err = decodeAcceptedValue(key, buf); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(filename); err != nil {
+			return nil, err
+		}
+		delete(a.cold, key)
+		a.promotions.Add(1)
+	}
+
+	a.hot[key] = a.lru.PushFront(e)
+	a.used += e.size()
+	a.keys.Set(float64(len(a.hot) + len(a.cold)))
+	return e, nil
+}
+
+// evict spills least recently used entries to disk until memory use is within
+// budget. The most recently used entry is always kept in memory.
+func (a *TieredAcceptor) evict() error {
+	defer func() { a.memory.Set(float64(a.used)) }()
+	for a.used > a.budget && a.lru.Len() > 1 {
+		elem := a.lru.Back()
+		e := elem.Value.(*tieredEntry)
+		if err := ioutil.WriteFile(a.filename(e.key), encodeAcceptedValue(e.key, e.av), 0600); err != nil {
+			return err
+		}
+		a.lru.Remove(elem)
+		delete(a.hot, e.key)
+		a.cold[e.key] = true
+		a.used -= e.size()
+		a.spills.Add(1)
+	}
+	return nil
+}
+
+// Keys are hashed so that arbitrary strings produce safe filenames.
+func (a *TieredAcceptor) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(a.dir, hex.EncodeToString(sum[:]))
+}
+
+func (a *TieredAcceptor) dumpValue(key string) []byte {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	e, err := a.load(key)
+	if err != nil {
+		return nil
+	}
+	defer a.evict()
+	dst := make([]byte, len(e.av.value))
+	copy(dst, e.av.value)
+	return dst
+}
+
+// The on-disk format of an entry, used for spilled tiered values and disk
+// acceptor log records, is the key, the promise and accepted ballots, a flag
+// distinguishing a nil value from an empty one, and the value. The key is
+// stored to detect hash collisions and corruption, and the value's length, to
+// detect truncation.
+func encodeAcceptedValue(key string, av acceptedValue) []byte {
+	buf := make([]byte, 0, encodedAcceptedValueSize(key, av))
+	buf = appendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	for _, b := range []Ballot{av.promise, av.accepted} {
+		buf = appendUint64(buf, b.Epoch)
+		buf = appendUint64(buf, b.Counter)
+		buf = appendUint64(buf, b.ID)
+	}
+	if av.value == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	buf = appendUint32(buf, uint32(len(av.value)))
+	return append(buf, av.value...)
+}
+
+func encodedAcceptedValueSize(key string, av acceptedValue) int {
+	if av.value == nil {
+		return 4 + len(key) + 2*3*8 + 1
+	}
+	return 4 + len(key) + 2*3*8 + 1 + 4 + len(av.value)
+}
+
+var errCorruptValue = errors.New("corrupt stored value")
+
+func decodeAcceptedValue(key string, buf []byte) (av acceptedValue, err error) {
+	if len(buf) < 4 {
+		return av, errCorruptValue
+	}
+	n := int(binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	if len(buf) < n+2*3*8+1 || string(buf[:n]) != key {
+		return av, errCorruptValue
+	}
+	buf = buf[n:]
+	for _, b := range []*Ballot{&av.promise, &av.accepted} {
+		b.Epoch = binary.BigEndian.Uint64(buf[0:])
+		b.Counter = binary.BigEndian.Uint64(buf[8:])
+		b.ID = binary.BigEndian.Uint64(buf[16:])
+		buf = buf[24:]
+	}
+	switch {
+	case buf[0] == 0 && len(buf) == 1:
+		return av, nil
+	case buf[0] == 1 && len(buf) >= 5 && len(buf)-5 == int(binary.BigEndian.Uint32(buf[1:])):
+		av.value = append([]byte{}, buf[5:]...)
+		return av, nil
+	default:
+		return av, errCorruptValue
+	}
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
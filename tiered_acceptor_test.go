@@ -0,0 +1,101 @@
+package caspaxos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+var _ Acceptor = (*TieredAcceptor)(nil)
+
+func TestTieredAcceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caspaxos-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each acceptor has room for only a couple of keys in memory.
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		m      = newTestMetrics()
+		budget = 2 * (tieredEntryOverhead + 16)
+		ctx    = context.Background()
+	)
+	acceptors := make([]Acceptor, 3)
+	for i := range acceptors {
+		a, err := NewTieredAcceptor(fmt.Sprint(i+1), dir, budget, AcceptorMetrics(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		acceptors[i] = a
+	}
+	p1 := NewLocalProposer(1, logger, acceptors...)
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		key, val := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		if _, err := p1.Propose(ctx, key, changeFuncInitializeOnlyOnce(val)); err != nil {
+			t.Fatalf("write %s: %v", key, err)
+		}
+	}
+	if m.value("spills") == 0 {
+		t.Fatal("no keys were spilled to disk")
+	}
+
+	// Reading every key back promotes cold keys, and the values are intact.
+	for i := 0; i < n; i++ {
+		key, want := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		have, err := p1.Propose(ctx, key, changeFuncRead)
+		if err != nil {
+			t.Fatalf("read %s: %v", key, err)
+		}
+		if want != string(have) {
+			t.Errorf("read %s: want %q, have %q", key, want, string(have))
+		}
+	}
+	if m.value("promotions") == 0 {
+		t.Error("no keys were promoted from disk")
+	}
+
+	for _, a := range acceptors {
+		a := a.(*TieredAcceptor)
+		if used := a.used; used > budget {
+			t.Errorf("acceptor %s: memory use %d exceeds budget %d", a.Address(), used, budget)
+		}
+		if want, have := "v0", string(a.dumpValue("k0")); want != have {
+			t.Errorf("acceptor %s: want %q, have %q", a.Address(), want, have)
+		}
+	}
+}
+
+func TestAcceptedValueEncoding(t *testing.T) {
+	for _, av := range []acceptedValue{
+		{},
+		{promise: Ballot{Epoch: 1, Counter: 2, ID: 3}},
+		{accepted: Ballot{Counter: 4, ID: 5}, value: []byte{}},
+		{accepted: Ballot{Counter: 6, ID: 7}, value: []byte("hello")},
+	} {
+		have, err := decodeAcceptedValue("key", encodeAcceptedValue("key", av))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.promise != av.promise || have.accepted != av.accepted || (have.value == nil) != (av.value == nil) || string(have.value) != string(av.value) {
+			t.Errorf("want %+v, have %+v", av, have)
+		}
+	}
+	if _, err := decodeAcceptedValue("other", encodeAcceptedValue("key", acceptedValue{})); err == nil {
+		t.Error("mismatched key: want error, have none")
+	}
+	buf := encodeAcceptedValue("key", acceptedValue{value: []byte("hello")})
+	for n := 0; n < len(buf); n++ {
+		if _, err := decodeAcceptedValue("key", buf[:n]); err == nil {
+			t.Errorf("truncated to %d bytes: want error, have none", n)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package caspaxos
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Validator checks a value before it's proposed for key. A non-nil error
+// rejects the value.
+type Validator func(key string, value []byte) error
+
+// ValidationError is returned by Propose when a validator rejects the value
+// produced by the change function. The value isn't sent to the acceptors.
+type ValidationError struct {
+	Key string
+	Err error
+}
+
+func (ve ValidationError) Error() string {
+	return fmt.Sprintf("invalid value for key %q: %v", ve.Key, ve.Err)
+}
+
+// ProposerValidator adds a validator for keys with the given prefix; an empty
+// prefix matches every key. Validators run after the change function, and
+// before the accept phase, so bad data is stopped before it can be chosen.
+// The option may be given more than once; every matching validator must pass.
+// By default, values aren't validated.
+func ProposerValidator(prefix string, v Validator) ProposerOption {
+	return func(p *LocalProposer) {
+		p.validators = append(p.validators, prefixValidator{prefix, v})
+	}
+}
+
+type prefixValidator struct {
+	prefix    string
+	validator Validator
+}
+
+// validate runs every validator matching key against value.
+func (p *LocalProposer) validate(key string, value []byte) error {
+	for _, v := range p.validators {
+		if !strings.HasPrefix(key, v.prefix) {
+			continue
+		}
+		if err := v.validator(key, value); err != nil {
+			return ValidationError{Key: key, Err: err}
+		}
+	}
+	return nil
+}
+
+// MaxValueSize returns a validator which rejects values larger than n bytes.
+func MaxValueSize(n int) Validator {
+	return func(key string, value []byte) error {
+		if len(value) > n {
+			return fmt.Errorf("value size %d exceeds maximum of %d bytes", len(value), n)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,31 @@
+package caspaxos
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProposerValidator(t *testing.T) {
+	var (
+		a1  = NewMemoryAcceptor("1")
+		a2  = NewMemoryAcceptor("2")
+		a3  = NewMemoryAcceptor("3")
+		p1  = NewLocalProposerWithOptions(1, nil, []Acceptor{a1, a2, a3}, ProposerValidator("small/", MaxValueSize(3)))
+		ctx = context.Background()
+	)
+	if _, err := p1.Propose(ctx, "small/k", changeFuncInitializeOnlyOnce("abc")); err != nil {
+		t.Fatalf("valid value: %v", err)
+	}
+
+	_, err := p1.Propose(ctx, "small/k", func([]byte) []byte { return []byte("abcd") })
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatalf("invalid value: want ValidationError, have %v", err)
+	}
+	if value, _ := p1.Propose(ctx, "small/k", changeFuncRead); string(value) != "abc" {
+		t.Errorf("invalid value was applied: have %q", value)
+	}
+
+	if _, err := p1.Propose(ctx, "other", changeFuncInitializeOnlyOnce("abcd")); err != nil {
+		t.Errorf("unmatched prefix: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Webhook is a registration for change notifications. Changes to keys with the
+// given prefix are POSTed to the URL. An empty prefix matches every key.
+type Webhook struct {
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+}
+
+// Webhook requests are signed, so receivers can authenticate them. The
+// timestamp header carries the time the request was sent, in Unix seconds. The
+// signature header carries the hex-encoded HMAC-SHA256, keyed with the sink's
+// secret, of the timestamp, a period, and the request body. Receivers should
+// use VerifyWebhook, which also rejects stale requests, so a captured request
+// can't be replayed later.
+const (
+	WebhookTimestampHeader = "X-Caspaxos-Timestamp"
+	WebhookSignatureHeader = "X-Caspaxos-Signature"
+)
+
+// DefaultWebhookRegistry is the key webhooks are registered under, if none is
+// given. It has SystemKeyPrefix, so ProtectSystemKeys covers it, like the
+// exporter's checkpoint.
+const DefaultWebhookRegistry = SystemKeyPrefix + "webhooks"
+
+// ErrWebhookSignature indicates that a webhook request's signature is missing,
+// invalid, or too old.
+var ErrWebhookSignature = errors.New("invalid webhook signature")
+
+// VerifyWebhook checks the signature of a webhook request with the given body,
+// and that it was sent no more than maxAge before now. Receivers should also
+// deduplicate events by position, since a request may be replayed within
+// maxAge, and since delivery is at-least-once anyway.
+func VerifyWebhook(r *http.Request, body []byte, secret []byte, maxAge time.Duration, now time.Time) error {
+	timestamp := r.Header.Get(WebhookTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	if age := now.Sub(time.Unix(sent, 0)); age > maxAge || age < -maxAge {
+		return ErrWebhookSignature
+	}
+	signature, err := hex.DecodeString(r.Header.Get(WebhookSignatureHeader))
+	if err != nil || !hmac.Equal(signature, signWebhook(secret, timestamp, body)) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+func signWebhook(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// AddWebhook registers a webhook in the registry stored under the given key,
+// or under DefaultWebhookRegistry if it's empty. Registering a URL again
+// replaces its prefix.
+func AddWebhook(ctx context.Context, proposer Proposer, registry string, w Webhook) error {
+	return updateWebhooks(ctx, proposer, registry, func(hooks []Webhook) []Webhook {
+		for i := range hooks {
+			if hooks[i].URL == w.URL {
+				hooks[i] = w
+				return hooks
+			}
+		}
+		return append(hooks, w)
+	})
+}
+
+// RemoveWebhook removes the webhook with the given URL from the registry. As
+// with AddWebhook, an empty registry means DefaultWebhookRegistry.
+func RemoveWebhook(ctx context.Context, proposer Proposer, registry string, url string) error {
+	return updateWebhooks(ctx, proposer, registry, func(hooks []Webhook) []Webhook {
+		for i := range hooks {
+			if hooks[i].URL == url {
+				return append(hooks[:i], hooks[i+1:]...)
+			}
+		}
+		return hooks
+	})
+}
+
+func updateWebhooks(ctx context.Context, proposer Proposer, registry string, f func([]Webhook) []Webhook) error {
+	var decodeErr error
+	_, err := proposer.Propose(ctx, webhookRegistry(registry), func(current []byte) []byte {
+		var hooks []Webhook
+		if decodeErr = decodeWebhooks(current, &hooks); decodeErr != nil {
+			return current
+		}
+		buf, _ := json.Marshal(f(hooks))
+		return buf
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+func webhookRegistry(registry string) string {
+	if registry == "" {
+		return DefaultWebhookRegistry
+	}
+	return registry
+}
+
+func decodeWebhooks(buf []byte, hooks *[]Webhook) error {
+	if buf == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(buf, hooks), "invalid webhook registry")
+}
+
+// WebhookSink is a Sink which POSTs change events, as JSON, to the webhooks
+// registered under a key in the cluster. Use it with an Exporter, which
+// provides batching and retries. The registry is read, via the proposer, once
+// per batch, so registrations take effect without a restart. The exporter
+// only publishes values which have changed, so reads never produce requests.
+//
+// A batch fails if any webhook fails. When it's retried, each webhook only
+// receives the events it hasn't acknowledged yet. Acknowledgements are only
+// remembered until a batch is delivered to every webhook.
+type WebhookSink struct {
+	proposer Proposer
+	registry string
+	secret   []byte
+	client   *http.Client
+	now      func() time.Time
+
+	mtx   sync.Mutex
+	acked map[string]map[string]bool // URL: events delivered since the last successful Publish
+}
+
+// WebhookSinkOption sets an optional parameter for a WebhookSink.
+type WebhookSinkOption func(*WebhookSink)
+
+// WebhookSinkClient sets the HTTP client. By default, http.DefaultClient.
+func WebhookSinkClient(client *http.Client) WebhookSinkOption {
+	return func(s *WebhookSink) { s.client = client }
+}
+
+// NewWebhookSink returns a WebhookSink which reads registrations from the
+// registry key via the proposer, and signs requests with secret. If registry
+// is empty, DefaultWebhookRegistry is used.
+func NewWebhookSink(proposer Proposer, registry string, secret []byte, options ...WebhookSinkOption) *WebhookSink {
+	s := &WebhookSink{
+		proposer: proposer,
+		registry: webhookRegistry(registry),
+		secret:   secret,
+		client:   http.DefaultClient,
+		now:      time.Now,
+		acked:    map[string]map[string]bool{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// webhookEvent is the JSON representation of a ChangeEvent.
+type webhookEvent struct {
+	Position uint64 `json:"position"`
+	Key      string `json:"key"`
+	Value    []byte `json:"value"` // base64; null if the key was deleted
+}
+
+// Publish implements Sink.
+func (s *WebhookSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	current, err := s.proposer.Propose(ctx, s.registry, func(x []byte) []byte { return x })
+	if err != nil {
+		return errors.Wrap(err, "reading webhook registry")
+	}
+	var hooks []Webhook
+	if err := decodeWebhooks(current, &hooks); err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, hook := range hooks {
+		if err := s.deliver(ctx, hook, events); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", hook.URL, err))
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(failed) > 0 {
+		registered := map[string]bool{}
+		for _, hook := range hooks {
+			registered[hook.URL] = true
+		}
+		for url := range s.acked {
+			if !registered[url] {
+				delete(s.acked, url)
+			}
+		}
+		return fmt.Errorf("webhook delivery failed: %s", strings.Join(failed, "; "))
+	}
+	s.acked = map[string]map[string]bool{}
+	return nil
+}
+
+// eventID identifies an event for acknowledgement. A batch that's retried
+// may hold different events at the same positions, if keys have changed
+// again in the meantime, so the value is part of the identity.
+func eventID(e ChangeEvent) string {
+	return fmt.Sprintf("%d/%q/%s", e.Position, e.Key, valueDigest(e.Value))
+}
+
+func (s *WebhookSink) deliver(ctx context.Context, hook Webhook, events []ChangeEvent) error {
+	s.mtx.Lock()
+	acked := s.acked[hook.URL]
+	s.mtx.Unlock()
+
+	var (
+		payload = []webhookEvent{}
+		ids     []string
+	)
+	for _, e := range events {
+		if acked[eventID(e)] || !strings.HasPrefix(e.Key, hook.Prefix) {
+			continue
+		}
+		payload = append(payload, webhookEvent{e.Position, e.Key, e.Value})
+		ids = append(ids, eventID(e))
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(struct {
+		Events []webhookEvent `json:"events"`
+	}{payload})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, hex.EncodeToString(signWebhook(s.secret, timestamp, body)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body) // so the connection can be reused
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	s.mtx.Lock()
+	if s.acked[hook.URL] == nil {
+		s.acked[hook.URL] = map[string]bool{}
+	}
+	for _, id := range ids {
+		s.acked[hook.URL][id] = true
+	}
+	s.mtx.Unlock()
+	return nil
+}
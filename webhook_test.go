@@ -0,0 +1,135 @@
+package caspaxos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var (
+		secret   = []byte("s3cret")
+		mtx      sync.Mutex
+		received = map[string][]string{} // path: keys
+		requests []*http.Request
+		failures = 1
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := VerifyWebhook(r, body, secret, time.Minute, time.Now()); err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests = append(requests, r)
+		if r.URL.Path == "/flaky" && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload struct {
+			Events []webhookEvent `json:"events"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		for _, e := range payload.Events {
+			received[r.URL.Path] = append(received[r.URL.Path], e.Key)
+		}
+	}))
+	defer server.Close()
+
+	var (
+		logger = log.NewLogfmtLogger(testWriter{t})
+		a1     = NewMemoryAcceptor("1")
+		a2     = NewMemoryAcceptor("2")
+		a3     = NewMemoryAcceptor("3")
+		p1     = NewLocalProposer(1, logger, a1, a2, a3)
+		keys   = []string{"user/1", "group/1", "user/2"}
+		ctx    = context.Background()
+	)
+	sink := NewWebhookSink(p1, "", secret)
+	exporter := NewExporter(sink, p1, "cdc", func(context.Context) ([]string, error) { return keys, nil })
+	for _, hook := range []Webhook{
+		{URL: server.URL + "/users", Prefix: "user/"},
+		{URL: server.URL + "/flaky"},
+	} {
+		if err := AddWebhook(ctx, p1, "", hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The default registry is a system key, so it can't be changed via a
+	// public API.
+	if err := AddWebhook(ctx, ProtectSystemKeys(p1), "", Webhook{URL: "http://evil"}); err != ErrSystemKey {
+		t.Errorf("registration via a protected proposer: want %v, have %v", ErrSystemKey, err)
+	}
+
+	for _, key := range keys {
+		if _, err := p1.Propose(ctx, key, changeFuncInitializeOnlyOnce("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first export fails, since one webhook fails. When it's retried,
+	// the other webhook doesn't receive the events again.
+	if err := exporter.Export(ctx); err == nil {
+		t.Fatal("first export: want error, have none")
+	}
+	if err := exporter.Export(ctx); err != nil {
+		t.Fatalf("second export: %v", err)
+	}
+	if want, have := 0, len(sink.acked); want != have {
+		t.Errorf("acknowledgements after a successful publish: want %d, have %d", want, have)
+	}
+
+	// Reads don't produce requests.
+	for _, key := range keys {
+		if _, err := p1.Propose(ctx, key, changeFuncRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtx.Lock()
+	n := len(requests)
+	mtx.Unlock()
+	if err := exporter.Export(ctx); err != nil {
+		t.Fatalf("export after reads: %v", err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if want, have := n, len(requests); want != have {
+		t.Errorf("requests after reads: want %d, have %d", want, have)
+	}
+
+	// A captured request can't be replayed once it's stale, nor can its body
+	// be changed.
+	r := requests[0]
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := VerifyWebhook(r, body, secret, time.Minute, time.Now().Add(2*time.Minute)); err != ErrWebhookSignature {
+		t.Errorf("stale request: want %v, have %v", ErrWebhookSignature, err)
+	}
+	if err := VerifyWebhook(r, append(body, ' '), secret, time.Minute, time.Now()); err != ErrWebhookSignature {
+		t.Errorf("modified request: want %v, have %v", ErrWebhookSignature, err)
+	}
+
+	for path, want := range map[string][]string{
+		"/users": {"user/1", "user/2"},
+		"/flaky": {"group/1", "user/1", "user/2"},
+	} {
+		if have := received[path]; fmt.Sprint(want) != fmt.Sprint(have) {
+			t.Errorf("%s: want %v, have %v", path, want, have)
+		}
+	}
+}